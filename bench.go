@@ -0,0 +1,105 @@
+package main
+
+import (
+	brc "brc/core"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func benchMain(args []string) {
+	tuned, err := loadTuneConfig(defaultTuneConfigPath())
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	inputPath := fs.String("input", "", "Input file path")
+	threadsLst := fs.String("threads", strconv.Itoa(tuned.Threads), "Comma separated thread counts")
+	chunkLst := fs.String("chunk", strconv.Itoa(tuned.Chunk), "Comma separated chunk sizes (factors of pagesize)")
+	readerLst := fs.String("reader", tuned.Reader, "Comma separated readers")
+	modeLst := fs.String("mode", tuned.Mode, "Comma separated strategies")
+	repeat := fs.Int("repeat", 5, "Runs per option set")
+	outputPath := fs.String("o", "-", "JSON report path (-=stdout)")
+	fs.String("config", "", "Config file of solve, for -input, -threads, -chunk, -reader, -mode, overridden by BRC_* env variables and flags (default=$BRC_CONFIG)")
+	parseConfigured(fs, args, "input", "threads", "chunk", "reader", "mode")
+	if len(*inputPath) == 0 {
+		usageAndExit(fs, "input is empty")
+	}
+	threads, err := parseIntList(*threadsLst)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	chunks, err := parseIntList(*chunkLst)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	readers, err := parseEnumList(*readerLst, brc.BrcReaderList)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	strategies, err := parseEnumList(*modeLst, brc.BrcStrategyList)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	tmpDir, err := os.MkdirTemp("", "brc-bench")
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	reports := make([]brc.BenchReport, 0)
+	grid := brc.TuneGrid(threads, chunks, readers, strategies)
+	for _, opts := range grid {
+		var report brc.BenchReport
+		if len(grid) == 1 {
+			report, err = brc.Bench(*inputPath, tmpDir, opts, *repeat)
+		} else {
+			// the peak RSS is a high-water mark of the process, one process per option set
+			report, err = benchProcess(*inputPath, opts, *repeat)
+		}
+		if err != nil {
+			stderrAndExit(err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "%s threads=%d chunk=%d reader=%s mode=%s: median %.3fs, %.2f GB/s\n",
+			report.Input, report.Threads, report.Chunk, report.Reader, report.Mode, report.MedianTime, report.GBPerSec)
+		reports = append(reports, report)
+	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	data = append(data, '\n')
+	if *outputPath == "-" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*outputPath, data, 0o644); err != nil {
+		stderrAndExit(err.Error())
+	}
+}
+
+// benchProcess runs brc bench on the single option set opts in a new process, and returns its report
+func benchProcess(inputPath string, opts brc.BrcOptions, repeat int) (brc.BenchReport, error) {
+	var report brc.BenchReport
+	executable, err := os.Executable()
+	if err != nil {
+		return report, err
+	}
+	cmd := exec.Command(executable, "bench", "-input", inputPath, "-repeat", strconv.Itoa(repeat),
+		"-threads", strconv.Itoa(opts.NThreads), "-chunk", strconv.Itoa(opts.ReadChunkFactor),
+		"-reader", string(opts.ReaderType), "-mode", string(opts.Strategy), "-o", "-")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return report, fmt.Errorf("Cannot bench threads=%d chunk=%d reader=%s mode=%s: %w: %s", opts.NThreads,
+			opts.ReadChunkFactor, opts.ReaderType, opts.Strategy, err, strings.TrimSpace(stderr.String()))
+	}
+	var reports []brc.BenchReport
+	if err := json.Unmarshal(data, &reports); err != nil || len(reports) != 1 {
+		return report, fmt.Errorf("Cannot read the bench report of threads=%d chunk=%d reader=%s mode=%s: %v",
+			opts.NThreads, opts.ReadChunkFactor, opts.ReaderType, opts.Strategy, err)
+	}
+	return reports[0], nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configAliases are the config keys of the short flags
+var configAliases = map[string]string{"o": "output", "v": "verbose", "p": "profile"}
+
+// configKey is the key of a flag in the config file, BRC_ + its upper case is its environment variable
+func configKey(flagName string) string {
+	if key, ok := configAliases[flagName]; ok {
+		return key
+	}
+	return flagName
+}
+
+func configEnv(key string) string {
+	return "BRC_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// loadConfigFile reads a JSON object or a TOML subset: key = value lines, strings quoted, # comments
+func loadConfigFile(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]string
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		config, err = parseJSONConfig(data)
+	} else {
+		config, err = parseTOMLConfig(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var values map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	config := make(map[string]string, len(values))
+	for key, value := range values {
+		switch value.(type) {
+		case string, json.Number, bool:
+			config[key] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: not a string, number or boolean", key)
+		}
+	}
+	return config, nil
+}
+
+func parseTOMLConfig(data []byte) (map[string]string, error) {
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			// a comment may follow the closing quote
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+		case strings.HasPrefix(value, "'"):
+			end := strings.IndexByte(value[1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", lineNumber)
+			}
+			value = value[1 : end+1]
+		default:
+			value, _, _ = strings.Cut(value, "#")
+			value = strings.TrimSpace(value)
+		}
+		config[key] = value
+	}
+	return config, scanner.Err()
+}
+
+// applyConfig sets the flags of fs not given on the command line from their BRC_* environment variable,
+// then from the config file if filename is not empty. Returns where the value of each flag comes from
+func applyConfig(fs *flag.FlagSet, filename string) (map[string]string, error) {
+	return applySharedConfig(fs, filename, nil)
+}
+
+// applySharedConfig is applyConfig for the flags of fs in shared, all if nil. The config file is the one of solve:
+// with shared, the keys of the other solve options are ignored, a key of no solve option is still an error
+func applySharedConfig(fs *flag.FlagSet, filename string, shared []string) (map[string]string, error) {
+	var config map[string]string
+	if len(filename) > 0 {
+		var err error
+		if config, err = loadConfigFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	sources := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	keys := make(map[string]bool)
+	if shared != nil {
+		solveFlags, _ := newSolveFlags("solve")
+		solveFlags.VisitAll(func(f *flag.Flag) {
+			keys[configKey(f.Name)] = true
+		})
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		key := configKey(f.Name)
+		if shared == nil {
+			keys[key] = true
+		} else if !slices.Contains(shared, f.Name) {
+			if _, ok := sources[f.Name]; !ok {
+				sources[f.Name] = "default"
+			}
+			return
+		}
+		if _, ok := sources[f.Name]; ok || err != nil || f.Name == "config" {
+			return
+		}
+		if value, ok := os.LookupEnv(configEnv(key)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("Invalid %s: %v", configEnv(key), setErr)
+			}
+			sources[f.Name] = configEnv(key)
+		} else if value, ok := config[key]; ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("Invalid %s in %s: %v", key, filename, setErr)
+			}
+			sources[f.Name] = filename
+		} else {
+			sources[f.Name] = "default"
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key := range config {
+		if !keys[key] {
+			return nil, fmt.Errorf("Unknown option %s in %s", key, filename)
+		}
+	}
+	return sources, nil
+}
+
+// showConfig prints the effective configuration of fs as a config file, with the source of each value
+func showConfig(w io.Writer, fs *flag.FlagSet, sources map[string]string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		if _, err := strconv.ParseFloat(value, 64); err != nil && value != "true" && value != "false" {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", configKey(f.Name), value, sources[f.Name])
+	})
+}
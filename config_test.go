@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLConfig(t *testing.T) {
+	config, err := parseTOMLConfig([]byte(`# brc config
+threads = 16
+
+reader = "mmap" # a comment after a quoted value
+spill-dir = 'C:\tmp\brc'
+max-memory = 4G # a comment after a bare value
+o = "a # b.out"
+verbose = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"threads": "16", "reader": "mmap", "spill-dir": `C:\tmp\brc`, "max-memory": "4G",
+		"o": "a # b.out", "verbose": "true"}
+	if !maps.Equal(config, expected) {
+		t.Errorf("got %v, expected %v", config, expected)
+	}
+	for _, invalid := range []string{"threads 16", `reader = "mmap`, "reader = 'mmap"} {
+		if _, err := parseTOMLConfig([]byte(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	config, err := parseJSONConfig([]byte(`{"threads": 16, "sample": 0.05, "reader": "mmap", "v": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"threads": "16", "sample": "0.05", "reader": "mmap", "v": "true"}
+	if !maps.Equal(config, expected) {
+		t.Errorf("got %v, expected %v", config, expected)
+	}
+	for _, invalid := range []string{`{"threads": [1, 2]}`, `{"table": {"mode": "shared"}}`, `{"threads": 16`} {
+		if _, err := parseJSONConfig([]byte(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+// TestApplyConfig checks the precedence: flag > BRC_* variable > config file > default
+func TestApplyConfig(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.Int("threads", 1, "")
+		fs.String("reader", "disk", "")
+		fs.String("order", "bytes", "")
+		fs.String("max-memory", "0", "")
+		fs.Bool("v", false, "")
+		return fs
+	}
+	dir := t.TempDir()
+	tomlFile, jsonFile := filepath.Join(dir, "brc.toml"), filepath.Join(dir, "brc.json")
+	os.WriteFile(tomlFile, []byte("threads = 4\nreader = \"mmap\"\norder = \"mean\"\nverbose = true\n"), 0o644)
+	os.WriteFile(jsonFile, []byte(`{"threads": 4, "reader": "mmap", "order": "mean", "verbose": true}`), 0o644)
+	for _, file := range []string{tomlFile, jsonFile} {
+		t.Setenv("BRC_READER", "disk")
+		t.Setenv("BRC_MAX_MEMORY", "1G")
+		fs := newFlags()
+		fs.Parse([]string{"-threads", "8"})
+		sources, err := applyConfig(fs, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string][2]string{
+			"threads":    {"8", "flag"},
+			"reader":     {"disk", "BRC_READER"},
+			"max-memory": {"1G", "BRC_MAX_MEMORY"},
+			"order":      {"mean", file},
+			"v":          {"true", file},
+		} {
+			if value := fs.Lookup(name).Value.String(); value != expected[0] || sources[name] != expected[1] {
+				t.Errorf("%s: got %s from %s, expected %s from %s", name, value, sources[name], expected[0], expected[1])
+			}
+		}
+		var buf bytes.Buffer
+		showConfig(&buf, fs, sources)
+		if !strings.Contains(buf.String(), `order = "mean" # `+file) || strings.Contains(buf.String(), "config =") {
+			t.Errorf("wrong config show:\n%s", buf.String())
+		}
+	}
+	// defaults without a file
+	fs := newFlags()
+	fs.Parse(nil)
+	sources, err := applyConfig(fs, "")
+	if err != nil || sources["order"] != "default" || fs.Lookup("order").Value.String() != "bytes" {
+		t.Errorf("got order %s from %s, %v", fs.Lookup("order").Value, sources["order"], err)
+	}
+	// unknown keys and invalid values are errors
+	unknown := filepath.Join(dir, "unknown.toml")
+	os.WriteFile(unknown, []byte("threads = 4\nthread = 8\n"), 0o644)
+	if _, err := applyConfig(newFlags(), unknown); err == nil || !strings.Contains(err.Error(), "Unknown option thread") {
+		t.Errorf("expected an unknown option error, got %v", err)
+	}
+	invalid := filepath.Join(dir, "invalid.toml")
+	os.WriteFile(invalid, []byte("threads = many\n"), 0o644)
+	if _, err := applyConfig(newFlags(), invalid); err == nil || !strings.Contains(err.Error(), "Invalid threads") {
+		t.Errorf("expected an invalid value error, got %v", err)
+	}
+	t.Setenv("BRC_THREADS", "many")
+	if _, err := applyConfig(newFlags(), ""); err == nil || !strings.Contains(err.Error(), "Invalid BRC_THREADS") {
+		t.Errorf("expected an invalid variable error, got %v", err)
+	}
+}
+
+// TestApplySharedConfig checks the subcommands take the options they share with solve from its config file
+func TestApplySharedConfig(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.Int("threads", 1, "")
+		fs.String("reader", "disk", "")
+		fs.Float64("min-value", -99.9, "")
+		return fs
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "brc.toml")
+	os.WriteFile(file, []byte("threads = 4\norder = \"mean\"\nspill = \"1G\"\n"), 0o644)
+	t.Setenv("BRC_READER", "mmap")
+	t.Setenv("BRC_MIN_VALUE", "-10")
+	fs := newFlags()
+	fs.Parse(nil)
+	sources, err := applySharedConfig(fs, file, []string{"threads", "reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][2]string{
+		"threads":   {"4", file},
+		"reader":    {"mmap", "BRC_READER"},
+		"min-value": {"-99.9", "default"},
+	} {
+		if value := fs.Lookup(name).Value.String(); value != expected[0] || sources[name] != expected[1] {
+			t.Errorf("%s: got %s from %s, expected %s from %s", name, value, sources[name], expected[0], expected[1])
+		}
+	}
+	// keys of no solve option are still errors
+	unknown := filepath.Join(dir, "unknown.toml")
+	os.WriteFile(unknown, []byte("min-value = -10\n"), 0o644)
+	if _, err := applySharedConfig(newFlags(), unknown, []string{"threads", "reader"}); err == nil || !strings.Contains(err.Error(), "Unknown option min-value") {
+		t.Errorf("expected an unknown option error, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package brc
+
+// slabs grow from the min to the max size, doubling each time
+const (
+	arenaRecordsMin = 256
+	arenaRecordsMax = 1 << 14
+	arenaNamesMin   = 16 << 10
+	arenaNamesMax   = 256 << 10
+)
+
+// stationArena allocates the names and records of a thread map in slabs, instead of two allocations
+// per station. Slabs are kept alive by the stations pointing in them, so mergeMaps and writeData use them
+// without copies. A nil *stationArena allocates each station on the heap
+type stationArena struct {
+	records []StationData // free records are after len
+	names   []byte        // free bytes are after len
+}
+
+// record returns a new record, its fields must all be set
+func (arena *stationArena) record() *StationData {
+	if arena == nil {
+		return &StationData{}
+	}
+	if len(arena.records) == cap(arena.records) {
+		arena.records = make([]StationData, 0, min(max(arenaRecordsMin, 2*cap(arena.records)), arenaRecordsMax))
+	}
+	arena.records = arena.records[:len(arena.records)+1]
+	return &arena.records[len(arena.records)-1]
+}
+
+// name returns a copy of s
+func (arena *stationArena) name(s []byte) []byte {
+	if arena == nil {
+		return append(make([]byte, 0, len(s)), s...)
+	}
+	if len(s) > cap(arena.names)-len(arena.names) {
+		arena.names = make([]byte, 0, max(len(s), min(max(arenaNamesMin, 2*cap(arena.names)), arenaNamesMax)))
+	}
+	start := len(arena.names)
+	arena.names = append(arena.names, s...)
+	return arena.names[start:len(arena.names):len(arena.names)]
+}
+
+// resetRecords reuses the current records slab, when the records are not used anymore (flushed in the shared table)
+func (arena *stationArena) resetRecords() {
+	arena.records = arena.records[:0]
+}
+
+// reset reuses the current slabs, when the records and names are not used anymore (spilled)
+func (arena *stationArena) reset() {
+	arena.records = arena.records[:0]
+	arena.names = arena.names[:0]
+}
@@ -0,0 +1,108 @@
+package brc
+
+import (
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// BenchReport aggregates repeated Solve runs of one BrcOptions, times are in seconds
+type BenchReport struct {
+	Input       string  `json:"input"`
+	Bytes       int64   `json:"bytes"`
+	Lines       int64   `json:"lines"`
+	Stations    int     `json:"stations"`
+	Threads     int     `json:"threads"`
+	Chunk       int     `json:"chunk"`
+	Reader      string  `json:"reader"`
+	Mode        string  `json:"mode"`
+	Repeat      int     `json:"repeat"`
+	MinTime     float64 `json:"min_s"`
+	MedianTime  float64 `json:"median_s"`
+	MaxTime     float64 `json:"max_s"`
+	GBPerSec    float64 `json:"gb_per_s"`    // for the median time
+	LinesPerSec float64 `json:"lines_per_s"` // for the median time
+	ReadTime    float64 `json:"read_s"`      // median of each phase
+	ParseTime   float64 `json:"parse_s"`
+	MergeTime   float64 `json:"merge_s"`
+	WriteTime   float64 `json:"write_s"`
+	Allocs      uint64  `json:"allocs"`         // heap allocations per run
+	AllocBytes  uint64  `json:"alloc_bytes"`    // heap bytes allocated per run
+	PeakRSS     int64   `json:"peak_rss_bytes"` // high-water mark of the process, including its runs before Bench
+}
+
+// Bench runs Solve repeat times on filename with opts, outputs are written in tmpDir.
+// A new reader is opened for each run so preload is measured too
+func Bench(filename, tmpDir string, opts BrcOptions, repeat int) (BenchReport, error) {
+	repeat = max(repeat, 1)
+	report := BenchReport{
+		Input:   filename,
+		Threads: opts.NThreads,
+		Chunk:   opts.ReadChunkFactor,
+		Reader:  string(opts.ReaderType),
+		Mode:    string(opts.Strategy),
+		Repeat:  repeat,
+	}
+	fileOut := filepath.Join(tmpDir, filepath.Base(filename)+".out")
+	var totals, reads, parses, merges, writes []time.Duration
+	var memBefore, memAfter runtime.MemStats
+	for range repeat {
+		fileReader, err := NewFileReader(opts.ReaderType)
+		if err != nil {
+			return report, err
+		}
+		if err = fileReader.Open(filename); err != nil {
+			return report, err
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&memBefore)
+		timeBefore := time.Now()
+		stats, err := SolveWithStats(fileReader, fileOut, opts)
+		totals = append(totals, time.Since(timeBefore))
+		runtime.ReadMemStats(&memAfter)
+		fileReader.Close()
+		if err != nil {
+			return report, err
+		}
+		reads = append(reads, stats.ReadTime)
+		parses = append(parses, stats.ParseTime)
+		merges = append(merges, stats.MergeTime)
+		writes = append(writes, stats.WriteTime)
+		report.Bytes, report.Lines, report.Stations = stats.Bytes, stats.Lines, stats.Stations
+		report.Allocs += memAfter.Mallocs - memBefore.Mallocs
+		report.AllocBytes += memAfter.TotalAlloc - memBefore.TotalAlloc
+	}
+	report.Allocs /= uint64(repeat)
+	report.AllocBytes /= uint64(repeat)
+	slices.Sort(totals)
+	report.MinTime = totals[0].Seconds()
+	report.MedianTime = median(totals).Seconds()
+	report.MaxTime = totals[len(totals)-1].Seconds()
+	report.GBPerSec = float64(report.Bytes) / 1e9 / report.MedianTime
+	report.LinesPerSec = float64(report.Lines) / report.MedianTime
+	report.ReadTime = median(reads).Seconds()
+	report.ParseTime = median(parses).Seconds()
+	report.MergeTime = median(merges).Seconds()
+	report.WriteTime = median(writes).Seconds()
+	report.PeakRSS = peakRSS()
+	return report, nil
+}
+
+func median(durations []time.Duration) time.Duration {
+	sorted := slices.Sorted(slices.Values(durations))
+	return sorted[len(sorted)/2]
+}
+
+// peakRSS is the max resident set size of the process since its start
+func peakRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	if runtime.GOOS == "darwin" { // bytes on macOS, kilobytes elsewhere
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) * 1024
+}
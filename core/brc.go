@@ -2,6 +2,7 @@ package brc
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -29,32 +30,196 @@ type BrcOptions struct {
 	Strategy        BrcStrategyType // load data upfront or lazyload
 	ReaderType      BrcReaderType   // read on disk or mmap file
 	Verbose         bool            // print things in Solve(...) or not
+	MaxMemory       int64           // memory budget in bytes for buffers, preload and stations, 0=unlimited
+	TraceFile       string          // if set, write a chrome trace of all threads in it, and print their stats
+	Metrics         *RunMetrics     // if set, updated during and after the run
+	Order           BrcOrderType    // order of the output, BrcOrderBytes if empty
+	Number          BrcNumberType   // values format, BrcNumberFast if empty
+	Precision       int             // decimals of the output, 1 if 0, BrcPrecisionInteger for none
+	MaxKeySize      int             // longest station name in bytes, MAX_KEY_SIZE if 0
+	MaxLineSize     int             // longest line in bytes, \n included, MaxKeySize+28 if 0
+	Table           BrcTableType    // station table of the threads, BrcTableAuto if empty
+	SpillMemory     int64           // if > 0, thread maps are spilled to disk when their stations use more
+	SpillDir        string          // directory of the spilled stations, os.TempDir() if empty
+	Sample          float64         // if in ]0, 1[, parse this fraction of the file, in random blocks of a chunk
+	SampleSeed      uint64          // seed of the sampled blocks
+}
+
+// outputPrecision is the number of decimals of the output
+func (opts BrcOptions) outputPrecision() int {
+	switch {
+	case opts.Precision == 0:
+		return 1
+	case opts.Precision < 0:
+		return 0
+	}
+	return opts.Precision
+}
+
+// SolveStats are the measures of one Solve run
+type SolveStats struct {
+	Bytes     int64         // input size
+	Lines     int64         // number of parsed lines
+	Stations  int           // number of unique stations
+	ReadTime  time.Duration // preload only
+	ParseTime time.Duration
+	MergeTime time.Duration
+	WriteTime time.Duration
+	Workers   []WorkerStats // one per parseFile thread
 }
 
 func Solve(fileReader FileReader, file_out string, opts BrcOptions) error {
+	_, err := SolveWithStats(fileReader, file_out, opts)
+	return err
+}
+
+// SolveWithStats is Solve, returning the time taken by each phase and the counters
+func SolveWithStats(fileReader FileReader, file_out string, opts BrcOptions) (SolveStats, error) {
+	var stationLst []*StationData
+	opts.Metrics.start()
+	stats, err := solve(fileReader, file_out, opts, &stationLst)
+	opts.Metrics.end(stats, stationLst, err)
+	return stats, err
+}
+
+func solve(fileReader FileReader, file_out string, opts BrcOptions, stationLst *[]*StationData) (SolveStats, error) {
 	var err error
+	stats := SolveStats{Bytes: fileReader.GetSize()}
+	if opts.Sample > 0 && (opts.MaxMemory > 0 || opts.SpillMemory > 0 || opts.Table == BrcTableShared) {
+		// sampled blocks are aggregated in maps of their own
+		return stats, fmt.Errorf("Sampling can't be used with a memory budget, spilling or the shared table")
+	}
+	if opts.Strategy == BrcStrategyPreRead && opts.MaxMemory > 0 && fileReader.GetSize() > opts.MaxMemory/2 {
+		// the whole file won't fit with the stations, fall back to lazy
+		opts.Strategy = BrcStrategyLazyRead
+		if opts.Verbose {
+			fmt.Printf("File too big for the memory budget, preload falls back to lazy\n")
+		}
+	}
+	blockSize := int64(opts.ReadChunkFactor * os.Getpagesize())
+	if blocks := sampledBlocks(fileReader.GetSize(), blockSize, opts); blocks != nil {
+		return solveSampled(fileReader, file_out, opts, blockSize, blocks, stats, stationLst, time.Now())
+	}
+	origin := time.Now()
+	timeBefore := origin
 	if opts.Strategy == BrcStrategyPreRead {
 		if _, err = fileReader.Read(); err != nil {
-			return err
+			return stats, err
+		}
+	}
+	stats.ReadTime = time.Since(timeBefore)
+	timeBefore = time.Now()
+	// sizes the station tables up front, rehashing millions of stations is slow
+	var estimated cardinality
+	if format, err := newLineFormat(opts); err == nil {
+		estimated = estimateCardinality(fileReader, format, 16, 64*1024)
+		if opts.Verbose {
+			fmt.Printf("Estimated %d unique stations and %d lines from samples\n", estimated.stations, estimated.lines)
+		}
+	}
+	var table *sharedTable
+	var spill *spillRuns
+	if opts.SpillMemory > 0 {
+		if spill, err = newSpillRuns(opts.SpillDir); err != nil {
+			return stats, err
+		}
+		defer spill.close()
+	} else if useSharedTable(opts, estimated.stations) {
+		table = newSharedTable(estimated.stations)
+		if opts.Verbose {
+			fmt.Printf("Shared station table\n")
 		}
 	}
-	timeBefore := time.Now()
 	var allStationMaps []MapStation = nil
-	if err := parseFile(fileReader, opts, &allStationMaps); err != nil {
-		return err
-	}
-	// estimate the final number of stations to limit allocation during loop
-	// quick and dirty but works: 877 => 1024, 1023 => 2048, 1024 => 2048
-	totalKeySize := 0
-	for _, m := range allStationMaps {
-		totalKeySize += len(m)
-	}
-	totalKeySize = (totalKeySize/len(allStationMaps)/1024 + 1) * 1024
-	stationLst := make([]*StationData, 0, totalKeySize)
-	mergeMaps(allStationMaps, &stationLst)
-	timeAfter := time.Since(timeBefore)
+	if err := parseFile(fileReader, opts, estimated, table, spill, &allStationMaps, &stats.Workers); err != nil {
+		return stats, err
+	}
+	stats.ParseTime = time.Since(timeBefore)
+	compare := stationCompareFunc(opts.Order, opts.Number != BrcNumberGeneral)
+	if spill != nil {
+		return solveSpilled(spill, file_out, opts, compare, stats, origin)
+	}
+	// the unique stations of all thread maps, from their keys, to size the merge output
+	var merged int64
+	if table != nil {
+		merged = table.len()
+	} else {
+		keys := &hyperLogLog{}
+		for i := range stats.Workers {
+			keys.merge(stats.Workers[i].keys)
+		}
+		merged = keys.estimate()
+	}
+	if opts.Verbose {
+		fmt.Printf("Estimated %d unique stations after parse\n", merged)
+	}
+	// with 3 standard errors of the estimate
+	*stationLst = make([]*StationData, 0, merged+merged/40+16)
+	if table != nil {
+		*stationLst = table.sortedStations(*stationLst, compare, len(allStationMaps))
+	} else {
+		mergeMaps(allStationMaps, stationLst, compare, stats.Workers)
+	}
+	stats.MergeTime = time.Since(timeBefore) - stats.ParseTime
+	stats.Stations = len(*stationLst)
+	for _, station := range *stationLst {
+		stats.Lines += int64(station.Size)
+	}
 	if opts.Verbose {
-		fmt.Printf("Time taken parse only: %s\n", timeAfter.String())
+		fmt.Printf("Time taken parse only: %s\n", (stats.ParseTime + stats.MergeTime).String())
+	}
+	timeBefore = time.Now()
+	err = writeData(file_out, *stationLst, opts.outputPrecision(), opts.Number != BrcNumberGeneral)
+	stats.WriteTime = time.Since(timeBefore)
+	if err != nil {
+		return stats, err
+	}
+	return stats, reportWorkers(opts, stats, origin)
+}
+
+// solveSpilled merges the spilled partitions and streams them sorted in file_out
+func solveSpilled(spill *spillRuns, file_out string, opts BrcOptions, compare func(a, b *StationData) int, stats SolveStats, origin time.Time) (SolveStats, error) {
+	timeBefore := time.Now()
+	if err := spill.sortPartitions(compare, max(1, len(stats.Workers))); err != nil {
+		return stats, err
+	}
+	stats.MergeTime = time.Since(timeBefore)
+	if opts.Verbose {
+		fmt.Printf("Time taken parse only: %s\n", (stats.ParseTime + stats.MergeTime).String())
+	}
+	timeBefore = time.Now()
+	out, err := createOutput(file_out)
+	if err != nil {
+		return stats, err
+	}
+	defer out.abort()
+	writer := newStationWriter(out, opts.outputPrecision(), opts.Number != BrcNumberGeneral)
+	if stats.Stations, stats.Lines, err = spill.writeSorted(writer, compare); err != nil {
+		return stats, err
+	}
+	if err = writer.close(); err != nil {
+		return stats, err
+	}
+	if err = out.commit(); err != nil {
+		return stats, err
+	}
+	stats.WriteTime = time.Since(timeBefore)
+	return stats, reportWorkers(opts, stats, origin)
+}
+
+// reportWorkers prints the worker stats and writes the trace if asked
+func reportWorkers(opts BrcOptions, stats SolveStats, origin time.Time) error {
+	if opts.Verbose || len(opts.TraceFile) > 0 {
+		printWorkerStats(os.Stderr, stats.Workers)
+	}
+	if len(opts.TraceFile) == 0 {
+		return nil
+	}
+	mainSpans := []traceSpan{
+		{"read", origin, stats.ReadTime},
+		{"parse", origin.Add(stats.ReadTime), stats.ParseTime},
+		{"merge", origin.Add(stats.ReadTime + stats.ParseTime), stats.MergeTime},
+		{"write", origin.Add(stats.ReadTime + stats.ParseTime + stats.MergeTime), stats.WriteTime},
 	}
-	return writeData(file_out, stationLst)
+	return writeTrace(opts.TraceFile, origin, mainSpans, stats.Workers)
 }
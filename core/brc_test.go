@@ -1,15 +1,24 @@
 package brc
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const samplesRootDir = "../samples"
@@ -66,11 +75,27 @@ func testFile(tmpDirPath string, fileReader FileReader, file string, opts BrcOpt
 		return err
 	}
 	if expected != computed {
-		return fmt.Errorf("Wrong output")
+		return wrongOutputError(expectedOutput, output)
 	}
 	return nil
 }
 
+// wrongOutputError lists the differences between the expected and computed results
+func wrongOutputError(expectedOutput, output string) error {
+	diffs, err := DiffResultFiles(expectedOutput, output, 0)
+	if err != nil {
+		return fmt.Errorf("Wrong output: %v", err)
+	}
+	if len(diffs) == 0 {
+		return fmt.Errorf("Wrong output: same values, different formatting")
+	}
+	lines := make([]string, 0, 10)
+	for _, diff := range diffs[:min(len(diffs), 10)] {
+		lines = append(lines, diff.String())
+	}
+	return fmt.Errorf("Wrong output, %d differences:\n%s", len(diffs), strings.Join(lines, "\n"))
+}
+
 // TestSamples test all test cases in samples directory
 func TestSamples(t *testing.T) {
 	files := getSamples(samplesRootDir)
@@ -304,3 +329,1268 @@ func TestFileMmapReader(t *testing.T) {
 		t.Fatal("File should be closed")
 	}
 }
+
+// randomLines build n valid lines, names picked in a small set so keys repeat
+func randomLines(rng *rand.Rand, n int) []byte {
+	var buf bytes.Buffer
+	for range n {
+		nameLen := 1 + rng.IntN(100)
+		for range nameLen {
+			buf.WriteByte(byte('A' + rng.IntN(4)))
+		}
+		fmt.Fprintf(&buf, ";%.1f\n", float64(rng.IntN(1999)-999)/10)
+	}
+	return buf.Bytes()
+}
+
+// checkSeparatorMasks compare a scanner with the pure Go one on random buffers
+func checkSeparatorMasks(t *testing.T, scanner func(src []byte, semi, nl []uint64)) {
+	rng := rand.New(rand.NewPCG(42, 26))
+	alphabet := []byte{';', '\n', 'a', 0, 0xFF, 0x3b ^ 0x80}
+	for range 2000 {
+		src := make([]byte, rng.IntN(maskBlockSize+1))
+		for i := range src {
+			src[i] = alphabet[rng.IntN(len(alphabet))]
+		}
+		nWords := (len(src) + 63) / 64
+		semi, nl := make([]uint64, nWords), make([]uint64, nWords)
+		semiRef, nlRef := make([]uint64, nWords), make([]uint64, nWords)
+		scanner(src, semi, nl)
+		separatorMasksGeneric(src, semiRef, nlRef)
+		if !slices.Equal(semi, semiRef) || !slices.Equal(nl, nlRef) {
+			t.Fatalf("masks differ for a %d bytes buffer", len(src))
+		}
+	}
+}
+
+func TestSeparatorMasks(t *testing.T) {
+	if separatorMasks == nil {
+		t.Skip("no SIMD scanner on this cpu")
+	}
+	checkSeparatorMasks(t, separatorMasks)
+}
+
+// TestParseLinesMasked compare the bitmask parser with the SWAR one on random lines
+func TestParseLinesMasked(t *testing.T) {
+	if separatorMasks == nil {
+		t.Skip("no SIMD scanner on this cpu")
+	}
+	malformed := []string{"abc;12345.67\n", "a;b;1.0\n", "nosemi\n", "\n", "a;\n", "a;-\n", "a;5.\n", "a;1;2;3;4;5\n",
+		strings.Repeat("k", MAX_KEY_SIZE+1) + ";1.0\n", strings.Repeat("k", MAX_KEY_SIZE) + ";1.0\n", "abc;1.0", "abc"}
+	rng := rand.New(rand.NewPCG(7, 26))
+	for i := range 400 {
+		lines := randomLines(rng, rng.IntN(500))
+		if i%2 == 1 { // a malformed line in the middle, at the end or split over blocks
+			at := rng.IntN(len(lines) + 1)
+			at = bytes.LastIndexByte(lines[:at], '\n') + 1
+			bad := malformed[i/2%len(malformed)]
+			if bad[len(bad)-1] != '\n' {
+				at = len(lines)
+			}
+			lines = slices.Concat(lines[:at], []byte(bad), lines[at:])
+		}
+		masked, swar := make(MapStation), make(MapStation)
+		maskedErr := parseLinesMasked(lines, masked, nil, MAX_KEY_SIZE)
+		swarErr := parseLinesSWAR(lines, swar, nil, MAX_KEY_SIZE)
+		if fmt.Sprint(maskedErr) != fmt.Sprint(swarErr) {
+			t.Fatalf("got error %v, expected %v", maskedErr, swarErr)
+		}
+		if len(masked) != len(swar) {
+			t.Fatalf("got %d stations, expected %d", len(masked), len(swar))
+		}
+		for k, v := range swar {
+			w, ok := masked[k]
+			if !ok || !bytes.Equal(w.Name, v.Name) || w.Min != v.Min || w.Max != v.Max || w.Sum != v.Sum || w.Size != v.Size {
+				t.Fatalf("station %q differs", v.Name)
+			}
+		}
+	}
+	for _, bad := range []string{"abc;12345.67\n", "nosemi\nabc;1.0\n"} {
+		if err := parseLinesMasked([]byte(bad), make(MapStation), nil, MAX_KEY_SIZE); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestTune(t *testing.T) {
+	file := filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")
+	candidates := TuneGrid([]int{1, 4}, []int{1, 16}, BrcReaderList, BrcStrategyList)
+	if len(candidates) != 16 {
+		t.Fatalf("expected 16 candidates, got %d", len(candidates))
+	}
+	seen := 0
+	best, err := Tune(file, t.TempDir(), candidates, 1, func(TuneResult) { seen++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(candidates) {
+		t.Errorf("onResult called %d times, expected %d", seen, len(candidates))
+	}
+	if best.Duration <= 0 || best.Throughput <= 0 {
+		t.Errorf("invalid best result: %+v", best)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	for str, expected := range map[string]int64{"0": 0, "512": 512, "64K": 64 << 10, "512MB": 512 << 20, "2g": 2 << 30} {
+		if n, err := ParseByteSize(str); err != nil || n != expected {
+			t.Errorf("ParseByteSize(%q) = %d, %v, expected %d", str, n, err, expected)
+		}
+	}
+	if _, err := ParseByteSize("12X"); err == nil {
+		t.Error("ParseByteSize should fail on unknown unit")
+	}
+	pageSize := int64(os.Getpagesize())
+	_, chunkSize, nThreads := calcChunkAndThreadSize(1<<30, 256, 64, 64*pageSize, MAX_LINE_SIZE)
+	if int64(nThreads)*lazyBufferSize(int64(chunkSize), MAX_LINE_SIZE) > 32*pageSize {
+		t.Errorf("buffers out of budget: %d threads of %d bytes chunks", nThreads, chunkSize)
+	}
+	file := filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")
+	fileReader := NewFileDiskReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 4, Strategy: BrcStrategyPreRead, ReaderType: BrcReaderDisk, MaxMemory: 1 << 20}
+	if err := Solve(fileReader, filepath.Join(t.TempDir(), "out"), opts); err == nil {
+		t.Error("10000 stations should not fit in 1MB")
+	}
+	opts.MaxMemory = 1 << 24
+	if err := testFile(t.TempDir(), fileReader, file, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBench(t *testing.T) {
+	file := filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 4, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap}
+	report, err := Bench(file, t.TempDir(), opts, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Lines != 10000 || report.Stations != 10000 {
+		t.Errorf("expected 10000 lines and stations, got %d and %d", report.Lines, report.Stations)
+	}
+	if !(report.MinTime <= report.MedianTime && report.MedianTime <= report.MaxTime) {
+		t.Errorf("min/median/max not ordered: %+v", report)
+	}
+	if report.Allocs == 0 || report.PeakRSS == 0 {
+		t.Errorf("missing allocations or peak rss: %+v", report)
+	}
+}
+
+// TestGenerate check generated files are deterministic and their expected output matches Solve
+func TestGenerate(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	for name, opts := range map[string]GenOptions{
+		"gen-edge.txt":   {Rows: 3*genBlockRows/2 + 7, Seed: 3, EdgeCases: true, NThreads: 3},
+		"gen-unique.txt": {Rows: 50000, Seed: 4, UniqueKeys: 20000, NThreads: 2},
+	} {
+		file := filepath.Join(tmpDirPath, name)
+		if err := Generate(file, strings.Replace(file, ".txt", ".out", 1), opts); err != nil {
+			t.Fatal(err)
+		}
+		opts.NThreads = 1
+		if err := Generate(file+".1", "", opts); err != nil {
+			t.Fatal(err)
+		}
+		hashThreads, _ := hashFile(file)
+		hashOneThread, _ := hashFile(file + ".1")
+		if hashThreads != hashOneThread {
+			t.Errorf("%s: output depends on the number of threads", name)
+		}
+		fileReader := NewFileMmapReader()
+		if err := fileReader.Open(file); err != nil {
+			t.Fatal(err)
+		}
+		defer fileReader.Close()
+		for _, nThreads := range []int{1, 7} {
+			opts := BrcOptions{ReadChunkFactor: 4, NThreads: nThreads, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap}
+			if err := testFile(tmpDirPath, fileReader, file, opts); err != nil {
+				t.Errorf("%s, threads=%d: %s", name, nThreads, err)
+			}
+		}
+	}
+}
+
+// fuzzLines build nLines random lines with names up to maxNameLen bytes, utf8 included
+func fuzzLines(rng *rand.Rand, nLines, maxNameLen int) []byte {
+	alphabet := []string{"a", "Z", " ", "-", "é", "€", "🐝", "'"}
+	var buf bytes.Buffer
+	for range nLines {
+		nameLen := 1 + rng.IntN(maxNameLen)
+		for written := 0; written < nameLen; {
+			c := alphabet[rng.IntN(len(alphabet))]
+			if written+len(c) > nameLen {
+				c = "a"
+			}
+			buf.WriteString(c)
+			written += len(c)
+		}
+		value := rng.IntN(1999) - 999
+		buf.WriteByte(';')
+		if value < 0 {
+			buf.WriteByte('-')
+			value = -value
+		}
+		fmt.Fprintf(&buf, "%d.%d\n", value/10, value%10)
+	}
+	return buf.Bytes()
+}
+
+// FuzzSolve compares Solve with ReferenceSolve on random inputs and random options
+func FuzzSolve(f *testing.F) {
+	f.Add(uint64(1), uint16(1), uint8(100), uint8(1), uint8(1), false, false, uint8(0))
+	f.Add(uint64(2), uint16(3000), uint8(100), uint8(1), uint8(64), true, false, uint8(0))
+	f.Add(uint64(3), uint16(5000), uint8(10), uint8(2), uint8(7), false, true, uint8(0))
+	f.Add(uint64(4), uint16(200), uint8(100), uint8(1), uint8(12), true, true, uint8(0))
+	// regressions: 6 bytes last line, last thread on the final \n, -0.0 mean
+	f.Add(uint64(3), uint16(4983), uint8(0), uint8(32), uint8(7), false, false, uint8(0))
+	f.Add(uint64(69), uint16(223), uint8(160), uint8(1), uint8(51), false, false, uint8(0))
+	f.Add(uint64(56), uint16(4967), uint8(5), uint8(15), uint8(78), true, true, uint8(0))
+	f.Add(uint64(5), uint16(3000), uint8(100), uint8(1), uint8(5), false, false, uint8(7))
+	f.Add(uint64(6), uint16(3000), uint8(100), uint8(1), uint8(5), true, true, uint8(7))
+	f.Fuzz(func(t *testing.T, seed uint64, nLines uint16, maxNameLen, chunk, nThreads uint8, mmap, preload bool, dirty uint8) {
+		input := fuzzLines(rand.New(rand.NewPCG(seed, 31)), int(nLines%5000)+1, int(maxNameLen%100)+1)
+		// windows files: CRLF, BOM, no final newline
+		if dirty&1 != 0 {
+			input = bytes.ReplaceAll(input, []byte{'\n'}, []byte{'\r', '\n'})
+		}
+		if dirty&2 != 0 {
+			input = append(bytes.Clone(utf8BOM), input...)
+		}
+		if dirty&4 != 0 {
+			input = bytes.TrimSuffix(bytes.TrimSuffix(input, []byte{'\n'}), []byte{'\r'})
+		}
+		tmpDirPath := t.TempDir()
+		file := filepath.Join(tmpDirPath, "fuzz.txt")
+		if err := os.WriteFile(file, input, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		expected := filepath.Join(tmpDirPath, "expected.out")
+		if err := ReferenceSolve(bytes.NewReader(input), expected, BrcOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		opts := BrcOptions{
+			ReadChunkFactor: int(chunk%4) + 1,
+			NThreads:        int(nThreads%64) + 1,
+			Strategy:        BrcStrategyLazyRead,
+			ReaderType:      BrcReaderDisk,
+		}
+		if preload {
+			opts.Strategy = BrcStrategyPreRead
+		}
+		if mmap {
+			opts.ReaderType = BrcReaderMmap
+		}
+		fileReader, err := NewFileReader(opts.ReaderType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileReader.Open(file); err != nil {
+			t.Fatal(err)
+		}
+		defer fileReader.Close()
+		output := filepath.Join(tmpDirPath, "fuzz.out")
+		if err := Solve(fileReader, output, opts); err != nil {
+			t.Fatal(err)
+		}
+		expectedHash, _ := hashFile(expected)
+		computedHash, _ := hashFile(output)
+		if expectedHash != computedHash {
+			t.Errorf("%d bytes, chunk=%d, threads=%d, reader=%s, strategy=%s: %v",
+				len(input), opts.ReadChunkFactor, opts.NThreads, opts.ReaderType, opts.Strategy,
+				wrongOutputError(expected, output))
+		}
+	})
+}
+
+func TestWorkerStats(t *testing.T) {
+	file := filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")
+	tmpDirPath := t.TempDir()
+	fileReader := NewFileDiskReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 5, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderDisk,
+		TraceFile: filepath.Join(tmpDirPath, "trace.json")}
+	stats, err := SolveWithStats(fileReader, filepath.Join(tmpDirPath, "out"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, end := int64(0), int64(0)
+	for _, worker := range stats.Workers {
+		if worker.Start != end {
+			t.Errorf("worker %d starts at %d, expected %d", worker.Id, worker.Start, end)
+		}
+		end = worker.End
+		lines += worker.Lines
+	}
+	if lines != 10000 || end != fileReader.GetSize() {
+		t.Errorf("workers parsed %d lines up to %d, expected 10000 up to %d", lines, end, fileReader.GetSize())
+	}
+	data, err := os.ReadFile(opts.TraceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct{ TraceEvents []traceEvent }
+	if err := json.Unmarshal(data, &trace); err != nil || len(trace.TraceEvents) < len(stats.Workers)*2 {
+		t.Errorf("invalid trace (%d events): %v", len(trace.TraceEvents), err)
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	file := filepath.Join(samplesRootDir, "measurements-10.txt")
+	fileReader := NewFileDiskReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	metrics := NewRunMetrics(true)
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 2, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderDisk, Metrics: metrics}
+	if err := Solve(fileReader, filepath.Join(t.TempDir(), "out"), opts); err != nil {
+		t.Fatal(err)
+	}
+	metrics.end(SolveStats{}, nil, fmt.Errorf("failed run"))
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"brc_runs_total 2\n",
+		"brc_errors_total 1\n",
+		"brc_last_run_success 0\n",
+		"brc_lines 10\n",
+		fmt.Sprintf("brc_progress_bytes %d\n", fileReader.GetSize()),
+		"brc_station_measurements{station=\"Zagreb\"} 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics should contain %q", expected)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Error("metrics should end with # EOF")
+	}
+	if escaped := escapeLabel([]byte("a\"b\\c\nd")); escaped != `a\"b\\c\nd` {
+		t.Errorf("wrong label escaping: %s", escaped)
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"id2", "id10", -1}, {"id10", "id10", 0}, {"id10", "id9", 1}, {"a", "b", -1},
+		{"id01", "id1", -1}, {"id1a", "id1b", -1}, {"id", "id1", -1}, {"x99y", "x100", -1},
+		{"10", "9a", 1}, {"Zürich2", "Zürich10", -1},
+	} {
+		if got := naturalCompare([]byte(c.a), []byte(c.b)); got != c.expected {
+			t.Errorf("naturalCompare(%q, %q) = %d, expected %d", c.a, c.b, got, c.expected)
+		}
+		if got := naturalCompare([]byte(c.b), []byte(c.a)); got != -c.expected {
+			t.Errorf("naturalCompare(%q, %q) = %d, expected %d", c.b, c.a, got, -c.expected)
+		}
+	}
+}
+
+// TestOrder check id1..id10000 (in file order) is sorted the same way by natural and first orders
+func TestOrder(t *testing.T) {
+	file := filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")
+	tmpDirPath := t.TempDir()
+	fileReader := NewFileMmapReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	var expected []byte
+	for i := range 10000 {
+		expected = fmt.Appendf(expected, "id%d=1.0/1.0/1.0, ", i+1)
+	}
+	expected = append(append([]byte{'{'}, expected[:len(expected)-2]...), '}', '\n')
+	// all counts are equal, ties are in bytes order
+	expectedByCount, _ := os.ReadFile(strings.Replace(file, ".txt", ".out", 1))
+	for order, expected := range map[BrcOrderType][]byte{
+		BrcOrderNatural: expected, BrcOrderFirst: expected, BrcOrderCount: expectedByCount,
+	} {
+		for _, nThreads := range []int{1, 3, 16} {
+			opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: BrcStrategyPreRead, ReaderType: BrcReaderMmap, Order: order}
+			output := filepath.Join(tmpDirPath, "out")
+			if err := Solve(fileReader, output, opts); err != nil {
+				t.Fatal(err)
+			}
+			if computed, _ := os.ReadFile(output); !bytes.Equal(computed, expected) {
+				t.Errorf("order=%s, threads=%d: wrong output", order, nThreads)
+			}
+		}
+	}
+}
+
+func TestDiffResults(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	expectedFile := filepath.Join(tmpDirPath, "expected.out")
+	computedFile := filepath.Join(tmpDirPath, "computed.out")
+	os.WriteFile(expectedFile, []byte("{a=b, c=1.0/2.0/3.0, Abha=-5.0/18.0/50.1, Zürich=1.0/1.0/1.0}\n"), 0o644)
+	os.WriteFile(computedFile, []byte("{a=b, c=1.0/2.0/3.0, Abha=-5.0/18.1/50.3, id2=1.0/1.0/1.0}\n"), 0o644)
+	expected, err := ReadResults(expectedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 3 || expected[0].Name != "a=b, c" || expected[1].Mean != 18.0 {
+		t.Fatalf("wrong parsing: %+v", expected)
+	}
+	diffs, err := DiffResultFiles(expectedFile, computedFile, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDiffs := []string{`changed "Abha" max: 50.1 => 50.3 (delta +0.2)`, `missing "Zürich"`, `extra "id2"`}
+	if len(diffs) != len(expectedDiffs) {
+		t.Fatalf("expected %d diffs, got %v", len(expectedDiffs), diffs)
+	}
+	for i := range diffs {
+		if diffs[i].String() != expectedDiffs[i] {
+			t.Errorf("diff %d: expected %s, got %s", i, expectedDiffs[i], diffs[i])
+		}
+	}
+	// same results, from the brace and OpenMetrics formats
+	metrics := NewRunMetrics(true)
+	metrics.end(SolveStats{}, []*StationData{{Name: []byte("a=b, c"), Min: 1, Max: 3, Sum: 4, Size: 2}}, nil)
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	os.WriteFile(computedFile, buf.Bytes(), 0o644)
+	os.WriteFile(expectedFile, []byte("{a=b, c=1.0/2.0/3.0}\n"), 0o644)
+	if diffs, err := DiffResultFiles(expectedFile, computedFile, 0); err != nil || len(diffs) != 0 {
+		t.Errorf("brace and metrics results should be equal: %v %v", diffs, err)
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	for str, expected := range map[string]float64{
+		"0": 0, "-12.5": -12.5, "+4": 4, "1013.25": 1013.25, "-.5": -0.5, "7.": 7, "1.2e3": 1200,
+		"1.5E-2": 0.015, "123456789.123456789": 123456789.123456789, "1e300": 1e300, "0.000001": 1e-6,
+	} {
+		if got := ParseNumber([]byte(str)); got != expected {
+			t.Errorf("ParseNumber(%q) = %v, expected %v", str, got, expected)
+		}
+	}
+	for _, str := range []string{"", "-", ".", "1.2.3", "e5", "1e", "12a", "--1"} {
+		if got := ParseNumber([]byte(str)); !math.IsNaN(got) {
+			t.Errorf("ParseNumber(%q) = %v, expected NaN", str, got)
+		}
+	}
+}
+
+// TestGeneralRounding checks that general and fast means of one decimal values are the same. The fast format
+// rounds to hundredths first, different for a mean like 29.5454 of 11 values, so stations have up to 10 values
+func TestGeneralRounding(t *testing.T) {
+	rng := rand.New(rand.NewPCG(37, 4))
+	var fast, general bytes.Buffer
+	fastWriter, generalWriter := newStationWriter(&fast, 1, true), newStationWriter(&general, 1, false)
+	for i := range 20000 {
+		station := &StationData{Name: fmt.Appendf(nil, "s%d", i), Min: -99.9, Max: 99.9}
+		for station.Size = 0; station.Size < 1+i%10; station.Size++ {
+			station.Sum += float64(rng.IntN(1999)-999) / 10
+		}
+		fastWriter.write(station)
+		generalWriter.write(station)
+	}
+	fastWriter.close()
+	generalWriter.close()
+	if !bytes.Equal(fast.Bytes(), general.Bytes()) {
+		t.Error("general means differ from fast means")
+	}
+	// min and max are rounded like the mean, half away from zero
+	var out bytes.Buffer
+	writer := newStationWriter(&out, 1, false)
+	for _, value := range []float64{1.25, -1.25, 0.15} {
+		writer.write(&StationData{Name: fmt.Append(nil, value), Min: value, Max: value, Sum: value, Size: 1})
+	}
+	writer.close()
+	if expected := "{1.25=1.3/1.3/1.3, -1.25=-1.3/-1.3/-1.3, 0.15=0.2/0.2/0.2}\n"; out.String() != expected {
+		t.Errorf("got %q, expected %q", out.String(), expected)
+	}
+}
+
+// TestGeneralNumbers compares Solve with ReferenceSolve on pressure like values, with 2 decimals output
+func TestGeneralNumbers(t *testing.T) {
+	rng := rand.New(rand.NewPCG(37, 37))
+	formats := []string{"%.2f", "%+.0f", "%.3e", "%.1f", "%.0f\r"}
+	var input bytes.Buffer
+	for range 30000 {
+		fmt.Fprintf(&input, "station%d;", rng.IntN(50))
+		fmt.Fprintf(&input, formats[rng.IntN(len(formats))], 950+rng.Float64()*100)
+		input.WriteByte('\n')
+	}
+	tmpDirPath := t.TempDir()
+	file := filepath.Join(tmpDirPath, "pressure.txt")
+	if err := os.WriteFile(file, input.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(tmpDirPath, "expected.out")
+	if err := ReferenceSolve(bytes.NewReader(input.Bytes()), expected, BrcOptions{Number: BrcNumberGeneral, Precision: 2}); err != nil {
+		t.Fatal(err)
+	}
+	fileReader := NewFileMmapReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	for _, strategy := range BrcStrategyList {
+		for _, nThreads := range []int{1, 5, 32} {
+			opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: strategy, ReaderType: BrcReaderMmap,
+				Number: BrcNumberGeneral, Precision: 2}
+			output := filepath.Join(tmpDirPath, "pressure.out")
+			if err := Solve(fileReader, output, opts); err != nil {
+				t.Fatal(err)
+			}
+			// sums depend on the summation order, means can differ by one unit of the last decimal
+			diffs, err := DiffResultFiles(expected, output, 0.01)
+			if err != nil || len(diffs) > 0 {
+				t.Errorf("strategy=%s, threads=%d: %v %v", strategy, nThreads, diffs, err)
+			}
+		}
+	}
+	for input, expected := range map[string]string{
+		"a;1.0\na;abc\n": "invalid number",
+		"abc\nxyz;1.0\n": "has no ';'",
+		"a;1.0\nxyz;2.0": `"xyz;2.0" has no \n`,
+	} {
+		err := ParseLinesGeneral([]byte(input), make(MapStation), MAX_KEY_SIZE, MAX_LINE_SIZE)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected a %q error, got %v", input, expected, err)
+		}
+	}
+}
+
+// TestKeySize solves long keys, over the default size and the chunk size, and checks the limit errors
+func TestKeySize(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	solveBytes := func(input []byte, opts BrcOptions) error {
+		file := filepath.Join(tmpDirPath, "keys.txt")
+		if err := os.WriteFile(file, input, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fileReader, err := NewFileReader(opts.ReaderType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileReader.Open(file); err != nil {
+			t.Fatal(err)
+		}
+		defer fileReader.Close()
+		return Solve(fileReader, filepath.Join(tmpDirPath, "keys.out"), opts)
+	}
+	rng := rand.New(rand.NewPCG(38, 38))
+	for _, maxKeySize := range []int{256, 8192} {
+		input := fuzzLines(rng, 2_000_000/maxKeySize, maxKeySize)
+		expected := filepath.Join(tmpDirPath, "expected.out")
+		if err := ReferenceSolve(bytes.NewReader(input), expected, BrcOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, reader := range BrcReaderList {
+			for _, strategy := range BrcStrategyList {
+				for _, nThreads := range []int{1, 7, 64} {
+					opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: strategy, ReaderType: reader,
+						MaxKeySize: maxKeySize}
+					if err := solveBytes(input, opts); err != nil {
+						t.Fatalf("key size %d, %s %s %d threads: %v", maxKeySize, reader, strategy, nThreads, err)
+					}
+					output := filepath.Join(tmpDirPath, "keys.out")
+					expectedHash, _ := hashFile(expected)
+					if computedHash, _ := hashFile(output); computedHash != expectedHash {
+						t.Errorf("key size %d, %s %s %d threads: %v", maxKeySize, reader, strategy, nThreads,
+							wrongOutputError(expected, output))
+					}
+				}
+			}
+		}
+	}
+	long := bytes.Repeat([]byte{'u'}, 150)
+	input := []byte("short;1.0\n" + string(long) + ";2.0\nshort;3.0\n")
+	for _, strategy := range BrcStrategyList {
+		opts := BrcOptions{ReadChunkFactor: 1, NThreads: 1, Strategy: strategy, ReaderType: BrcReaderDisk}
+		if err := solveBytes(input, opts); err == nil || !strings.Contains(err.Error(), "max key size 100") {
+			t.Errorf("%s: expected a max key size error, got %v", strategy, err)
+		}
+		opts.MaxKeySize = 150
+		if err := solveBytes(input, opts); err != nil {
+			t.Errorf("%s: %v", strategy, err)
+		}
+		// a long value in the general format, over the line size but not the key size
+		opts.Number = BrcNumberGeneral
+		value := strings.Repeat("1", 200)
+		if err := solveBytes([]byte("short;1.0\nshort;"+value+"\n"), opts); err == nil || !strings.Contains(err.Error(), "max line size 178") {
+			t.Errorf("%s: expected a max line size error, got %v", strategy, err)
+		}
+	}
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 1, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderDisk,
+		MaxKeySize: 250, MaxLineSize: 200}
+	if err := solveBytes(input, opts); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("expected a max line size validation error, got %v", err)
+	}
+}
+
+// genHighCardinality generates a file with about 170k unique keys, over parallelMergeMin
+func genHighCardinality(tb testing.TB, dir string) (string, FileReader) {
+	file := filepath.Join(dir, "high-cardinality.txt")
+	if err := Generate(file, strings.Replace(file, ".txt", ".out", 1),
+		GenOptions{Rows: 400_000, Seed: 39, UniqueKeys: 200_000, NThreads: 4}); err != nil {
+		tb.Fatal(err)
+	}
+	fileReader := NewFileMmapReader()
+	if err := fileReader.Open(file); err != nil {
+		tb.Fatal(err)
+	}
+	return file, fileReader
+}
+
+// TestMergeMapsPartitioned compares the partitioned merge with the sequential one for all orders
+func TestMergeMapsPartitioned(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	file, fileReader := genHighCardinality(t, tmpDirPath)
+	defer fileReader.Close()
+	opts := BrcOptions{ReadChunkFactor: 4, NThreads: 8, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap}
+	if err := testFile(tmpDirPath, fileReader, file, opts); err != nil {
+		t.Fatal(err)
+	}
+	// traces the spans of parseFile and of the partitions, the trace file itself is not written
+	opts.TraceFile = filepath.Join(tmpDirPath, "trace.json")
+	for _, order := range BrcOrderList {
+		var sequential, partitioned []*StationData
+		var workers []WorkerStats
+		for _, merge := range []struct {
+			fn  func([]MapStation, *[]*StationData, func(a, b *StationData) int)
+			lst *[]*StationData
+		}{
+			{mergeMapsSequential, &sequential},
+			{func(allStationMaps []MapStation, stationLst *[]*StationData, compare func(a, b *StationData) int) {
+				mergeMapsPartitioned(allStationMaps, stationLst, compare, workers)
+			}, &partitioned},
+		} {
+			var allStationMaps []MapStation
+			if err := parseFile(fileReader, opts, cardinality{}, nil, nil, &allStationMaps, &workers); err != nil {
+				t.Fatal(err)
+			}
+			merge.fn(allStationMaps, merge.lst, stationCompareFunc(order, true))
+		}
+		for _, worker := range workers {
+			spans := make(map[string]int)
+			for _, span := range worker.spans {
+				spans[span.name]++
+			}
+			if spans["merge split"] != 1 || spans["merge"] != 1 {
+				t.Fatalf("%s: worker %d has %d split and %d merge spans, expected 1", order, worker.Id, spans["merge split"], spans["merge"])
+			}
+		}
+		if len(partitioned) < parallelMergeMin || len(partitioned) != len(sequential) {
+			t.Fatalf("%s: %d stations partitioned, %d sequential", order, len(partitioned), len(sequential))
+		}
+		for i, s := range sequential {
+			p := partitioned[i]
+			if !bytes.Equal(s.Name, p.Name) || s.Min != p.Min || s.Max != p.Max || s.Sum != p.Sum || s.Size != p.Size || s.First != p.First {
+				t.Fatalf("%s: station %d is %q, expected %q", order, i, p.Name, s.Name)
+			}
+		}
+	}
+}
+
+// BenchmarkMergeMaps merges the maps of 32 threads of a high-cardinality generated file
+func BenchmarkMergeMaps(b *testing.B) {
+	_, fileReader := genHighCardinality(b, b.TempDir())
+	defer fileReader.Close()
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 32, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap}
+	for name, merge := range map[string]func([]MapStation, *[]*StationData, func(a, b *StationData) int){
+		"sequential": mergeMapsSequential,
+		"partitioned": func(allStationMaps []MapStation, stationLst *[]*StationData, compare func(a, b *StationData) int) {
+			mergeMapsPartitioned(allStationMaps, stationLst, compare, nil)
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				var allStationMaps []MapStation
+				var workers []WorkerStats
+				if err := parseFile(fileReader, opts, cardinality{}, nil, nil, &allStationMaps, &workers); err != nil {
+					b.Fatal(err)
+				}
+				var stationLst []*StationData
+				b.StartTimer()
+				merge(allStationMaps, &stationLst, stationCompareFunc(BrcOrderBytes, true))
+			}
+		})
+	}
+}
+
+// TestSharedTable solves the samples and a high-cardinality file with the shared table, in all orders
+func TestSharedTable(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	for _, file := range getSamples(samplesRootDir) {
+		fileReader := NewFileDiskReader()
+		if err := fileReader.Open(file); err != nil {
+			t.Fatal(err)
+		}
+		defer fileReader.Close()
+		for _, nThreads := range []int{1, 3, 12} {
+			opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderDisk,
+				Table: BrcTableShared}
+			if err := testFile(tmpDirPath, fileReader, file, opts); err != nil {
+				t.Errorf("%s, threads=%d: %s", file, nThreads, err)
+			}
+		}
+	}
+	file, fileReader := genHighCardinality(t, tmpDirPath)
+	defer fileReader.Close()
+	for _, order := range BrcOrderList {
+		var outputs []string
+		for _, table := range []BrcTableType{BrcTableThread, BrcTableShared} {
+			// 2 threads flush their map several times
+			opts := BrcOptions{ReadChunkFactor: 4, NThreads: 2, Strategy: BrcStrategyPreRead, ReaderType: BrcReaderMmap,
+				Table: table, Order: order}
+			output := filepath.Join(tmpDirPath, fmt.Sprintf("%s-%s.out", order, table))
+			if err := Solve(fileReader, output, opts); err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, output)
+		}
+		threadHash, _ := hashFile(outputs[0])
+		sharedHash, _ := hashFile(outputs[1])
+		if threadHash != sharedHash {
+			t.Errorf("%s: %v", order, wrongOutputError(outputs[0], outputs[1]))
+		}
+	}
+	if _, err := os.Stat(strings.Replace(file, ".txt", ".out", 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEstimateCardinality(t *testing.T) {
+	format, _ := newLineFormat(BrcOptions{})
+	_, highReader := genHighCardinality(t, t.TempDir())
+	defer highReader.Close()
+	fileReader := NewFileDiskReader()
+	if err := fileReader.Open(filepath.Join(samplesRootDir, "measurements-10000-unique-keys.txt")); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	for _, test := range []struct {
+		fileReader FileReader
+		unique     int64
+		shared     bool
+		lines      int64
+	}{{fileReader, 10000, false, 10000}, {highReader, 173000, true, 400000}} {
+		estimate := estimateCardinality(test.fileReader, format, 16, 64*1024)
+		estimated := estimate.stations
+		if math.Abs(float64(estimate.lines-test.lines)) > 0.1*float64(test.lines) {
+			t.Errorf("%d lines estimated, expected %d", estimate.lines, test.lines)
+		}
+		if estimated < test.unique/2 || estimated > test.unique*2 {
+			t.Errorf("%d unique stations estimated, expected about %d", estimated, test.unique)
+		}
+		if shared := useSharedTable(BrcOptions{NThreads: 32}, estimated); shared != test.shared {
+			t.Errorf("%d unique stations: shared table=%t, expected %t", test.unique, shared, test.shared)
+		}
+	}
+	if useSharedTable(BrcOptions{NThreads: 32}, 413) {
+		t.Error("413 stations should use thread maps")
+	}
+	// thread maps have all the stations if they are on many lines, their share if they are all unique
+	for _, test := range []struct {
+		estimated cardinality
+		expected  int64
+	}{{cardinality{413, 1_000_000_000}, 413}, {cardinality{100_000, 100_000}, 25_000}, {cardinality{100_000, 400_000}, 63_212}} {
+		if stations := test.estimated.threadStations(4); stations != test.expected {
+			t.Errorf("%+v: %d stations per thread, expected %d", test.estimated, stations, test.expected)
+		}
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	var all, odd, even hyperLogLog
+	for i := range 1_000_000 {
+		key := getHashFromBytes([]byte(fmt.Sprintf("id%d", i)))
+		all.add(key)
+		if i%2 == 0 {
+			even.add(key)
+		} else {
+			odd.add(key)
+		}
+		if n := int64(i + 1); n == 10 || n == 1000 || n == 1_000_000 {
+			if estimate := all.estimate(); math.Abs(float64(estimate-n)) > 0.03*float64(n) {
+				t.Errorf("%d keys estimated, expected %d", estimate, n)
+			}
+		}
+	}
+	even.merge(&odd)
+	if even.estimate() != all.estimate() {
+		t.Errorf("merged estimate %d, expected %d", even.estimate(), all.estimate())
+	}
+}
+
+// TestSpill forces spills with a few stations per thread map, on the samples and a high-cardinality file
+func TestSpill(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	for _, file := range getSamples(samplesRootDir) {
+		fileReader := NewFileMmapReader()
+		if err := fileReader.Open(file); err != nil {
+			t.Fatal(err)
+		}
+		defer fileReader.Close()
+		for _, strategy := range BrcStrategyList {
+			for _, nThreads := range []int{1, 3, 12} {
+				for _, spillStations := range []int64{1, 7, 100} {
+					opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: strategy, ReaderType: BrcReaderMmap,
+						SpillMemory: spillStations * stationMemSize * int64(nThreads), SpillDir: tmpDirPath}
+					if err := testFile(tmpDirPath, fileReader, file, opts); err != nil {
+						t.Errorf("%s, %s, threads=%d, %d stations: %s", file, strategy, nThreads, spillStations, err)
+					}
+				}
+			}
+		}
+	}
+	_, fileReader := genHighCardinality(t, tmpDirPath)
+	defer fileReader.Close()
+	for _, order := range BrcOrderList {
+		var outputs []string
+		for _, spillMemory := range []int64{0, 1000 * stationMemSize} {
+			opts := BrcOptions{ReadChunkFactor: 4, NThreads: 4, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap,
+				Table: BrcTableThread, Order: order, SpillMemory: spillMemory, SpillDir: tmpDirPath}
+			output := filepath.Join(tmpDirPath, fmt.Sprintf("%s-%d.out", order, spillMemory))
+			if err := Solve(fileReader, output, opts); err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, output)
+		}
+		memoryHash, _ := hashFile(outputs[0])
+		spillHash, _ := hashFile(outputs[1])
+		if memoryHash != spillHash {
+			t.Errorf("%s: %v", order, wrongOutputError(outputs[0], outputs[1]))
+		}
+	}
+	// run files are removed
+	if matches, _ := filepath.Glob(filepath.Join(tmpDirPath, "brc-spill-*")); len(matches) > 0 {
+		t.Errorf("spill directories not removed: %v", matches)
+	}
+}
+
+// BenchmarkStationAllocs parses 100k unique keys (the 10000-unique-keys sample scaled up) into a new map,
+// with a station allocated on the heap or in an arena
+func BenchmarkStationAllocs(b *testing.B) {
+	file := filepath.Join(b.TempDir(), "unique-keys.txt")
+	if err := Generate(file, "", GenOptions{Rows: 1_000_000, Seed: 42, UniqueKeys: 100_000, NThreads: 4}); err != nil {
+		b.Fatal(err)
+	}
+	input, err := os.ReadFile(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for name, newArena := range map[string]func() *stationArena{
+		"heap":  func() *stationArena { return nil },
+		"arena": func() *stationArena { return &stationArena{} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for b.Loop() {
+				if err := parseLinesFast(input, make(MapStation, 1024), newArena(), MAX_KEY_SIZE); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	file := filepath.Join(tmpDirPath, "sample.txt")
+	expected := filepath.Join(tmpDirPath, "sample.out")
+	if err := Generate(file, expected, GenOptions{Rows: 500_000, Seed: 7, UniqueKeys: 20}); err != nil {
+		t.Fatal(err)
+	}
+	fileReader := NewFileMmapReader()
+	if err := fileReader.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	full, err := ReadResults(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fullStations []*StationData
+	if _, err := solve(fileReader, filepath.Join(tmpDirPath, "full.out"), BrcOptions{ReadChunkFactor: 1, NThreads: 1,
+		Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap}, &fullStations); err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, nThreads := range []int{1, 4} {
+		output := filepath.Join(tmpDirPath, fmt.Sprintf("sampled-%d.out", nThreads))
+		opts := BrcOptions{ReadChunkFactor: 1, NThreads: nThreads, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderMmap,
+			Sample: 0.2, SampleSeed: 3}
+		if err := Solve(fileReader, output, opts); err != nil {
+			t.Fatal(err)
+		}
+		hash, _ := hashFile(output)
+		hashes = append(hashes, hash)
+		sampled, err := ReadResults(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sampled) != len(full) {
+			t.Fatalf("expected %d stations, got %d", len(full), len(sampled))
+		}
+		covered := 0
+		for i, station := range sampled {
+			if station.Name != full[i].Name || station.MeanCI <= 0 {
+				t.Fatalf("wrong station %+v, expected %s", station, full[i].Name)
+			}
+			if math.Abs(station.Mean-full[i].Mean) <= station.MeanCI+0.1 {
+				covered++
+			}
+			if count := fullStations[i].Size; math.Abs(float64(station.Count-int64(count))) > 0.1*float64(count) {
+				t.Errorf("%s: estimated count %d, expected %d", station.Name, station.Count, count)
+			}
+		}
+		// 95% intervals, with the output rounding
+		if covered < len(full)*8/10 {
+			t.Errorf("%d of %d means in their confidence interval", covered, len(full))
+		}
+	}
+	// same seed, same blocks whatever the threads
+	if hashes[0] != hashes[1] {
+		t.Errorf("sampled outputs differ with the number of threads")
+	}
+	if blocks := sampledBlocks(100*4096, 4096, BrcOptions{NThreads: 1, Sample: 0.05, SampleSeed: 1}); len(blocks) != 5 {
+		t.Errorf("expected 5 sampled blocks, got %v", blocks)
+	}
+	if blocks := sampledBlocks(2*4096, 4096, BrcOptions{NThreads: 1, Sample: 0.05}); blocks != nil {
+		t.Errorf("all blocks should be parsed, got %v", blocks)
+	}
+	// options the sampled maps don't honor
+	for _, unsupported := range []BrcOptions{{MaxMemory: 1 << 30}, {SpillMemory: 1 << 20}, {Table: BrcTableShared}} {
+		opts := unsupported
+		opts.ReadChunkFactor, opts.NThreads, opts.Strategy, opts.ReaderType = 1, 4, BrcStrategyLazyRead, BrcReaderMmap
+		opts.Sample = 0.2
+		if err := Solve(fileReader, filepath.Join(tmpDirPath, "unsupported.out"), opts); err == nil {
+			t.Errorf("%+v: expected an error", unsupported)
+		}
+	}
+}
+
+// TestFollow appends lines to a followed file, the last one in two writes, and compares the output with Solve
+func TestFollow(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	input := filepath.Join(tmpDirPath, "follow.txt")
+	output := filepath.Join(tmpDirPath, "follow.out")
+	os.WriteFile(input, []byte("Abha;1.0\nZürich;-2.5\nAbha;3.0\nOslo;4"), 0o644)
+	stop := make(chan struct{})
+	done := make(chan error)
+	metrics := NewRunMetrics(true)
+	opts := BrcOptions{ReadChunkFactor: 1, NThreads: 2, Order: BrcOrderFirst, Metrics: metrics}
+	var refreshed atomic.Int64
+	go func() {
+		done <- Follow(input, output, opts, FollowOptions{Poll: 5 * time.Millisecond, Stop: stop, Refreshed: func() { refreshed.Add(1) }})
+	}()
+	waitOutput := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data, _ := os.ReadFile(output)
+			if string(data) == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q, got %q", expected, data)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// the incomplete line is not parsed
+	waitOutput("{Abha=1.0/2.0/3.0, Zürich=-2.5/-2.5/-2.5}\n")
+	file, err := os.OpenFile(input, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(".5\nBern;10.0\nAbha;8")
+	waitOutput("{Abha=1.0/2.0/3.0, Zürich=-2.5/-2.5/-2.5, Oslo=4.5/4.5/4.5, Bern=10.0/10.0/10.0}\n")
+	file.WriteString(".0\n")
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// each rewrite of the output is a run of the metrics
+	var body strings.Builder
+	metrics.WriteTo(&body)
+	for _, expected := range []string{
+		fmt.Sprintf("brc_runs_total %d\n", refreshed.Load()),
+		"brc_last_run_success 1\n",
+		"brc_running 0\n",
+		"brc_lines 6\n",
+		"brc_station_measurements{station=\"Abha\"} 3\n",
+	} {
+		if !strings.Contains(body.String(), expected) {
+			t.Errorf("metrics should contain %q:\n%s", expected, body.String())
+		}
+	}
+	// the threads of the first parse, lowered to 1 for a small file
+	if !strings.Contains(body.String(), "brc_threads ") || strings.Contains(body.String(), "brc_threads 0\n") {
+		t.Errorf("metrics should count the parse threads:\n%s", body.String())
+	}
+	if refreshed.Load() < 3 {
+		t.Errorf("expected a refresh per rewrite, got %d", refreshed.Load())
+	}
+	opts.Metrics = nil
+	expected := filepath.Join(tmpDirPath, "expected.out")
+	fileReader := NewFileDiskReader()
+	if err := fileReader.Open(input); err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	opts.Strategy, opts.ReaderType = BrcStrategyLazyRead, BrcReaderDisk
+	if err := Solve(fileReader, expected, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(expected)
+	waitOutput(string(data))
+	// no temporary output left
+	if matches, _ := filepath.Glob(filepath.Join(tmpDirPath, ".*.tmp")); len(matches) > 0 {
+		t.Errorf("temporary outputs not removed: %v", matches)
+	}
+}
+
+// TestOutput checks an output is replaced only once complete
+func TestOutput(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	output := filepath.Join(tmpDirPath, "result.out")
+	os.WriteFile(output, []byte("previous\n"), 0o644)
+	stations := []*StationData{{Name: []byte("Abha"), Min: 1, Max: 3, Sum: 4, Size: 2}}
+	out, err := createOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.WriteString("{Abha=")
+	if data, _ := os.ReadFile(output); string(data) != "previous\n" {
+		t.Errorf("partial output visible: %q", data)
+	}
+	out.abort()
+	if data, _ := os.ReadFile(output); string(data) != "previous\n" {
+		t.Errorf("aborted output replaced the previous one: %q", data)
+	}
+	if err := writeData(output, stations, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(output); string(data) != "{Abha=1.0/2.0/3.0}\n" {
+		t.Errorf("wrong output: %q", data)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(tmpDirPath, ".*.tmp")); len(matches) > 0 {
+		t.Errorf("temporary outputs not removed: %v", matches)
+	}
+	if err := writeData(filepath.Join(tmpDirPath, "missing", "result.out"), stations, 1, true); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+	// devices are written in place, not replaced
+	if err := writeData(os.DevNull, stations, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(os.DevNull); err != nil || info.Mode().IsRegular() {
+		t.Errorf("%s replaced: %v", os.DevNull, err)
+	}
+}
+
+func TestMergeResultFiles(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	var files []string
+	for i, stations := range [][]*StationData{
+		{{Name: []byte("Abha"), Min: 1, Max: 3, Sum: 4, Size: 2}, {Name: []byte("Oslo"), Min: -1, Max: -1, Sum: -1, Size: 1}},
+		{{Name: []byte("Abha"), Min: 5, Max: 5, Sum: 5, Size: 1}},
+	} {
+		metrics := NewRunMetrics(true)
+		metrics.end(SolveStats{}, stations, nil)
+		var buf bytes.Buffer
+		metrics.WriteTo(&buf)
+		files = append(files, filepath.Join(tmpDirPath, fmt.Sprintf("part-%d.prom", i)))
+		os.WriteFile(files[i], buf.Bytes(), 0o644)
+	}
+	output := filepath.Join(tmpDirPath, "merged.out")
+	if err := MergeResultFiles(files, output, BrcOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(output); string(data) != "{Abha=1.0/3.0/5.0, Oslo=-1.0/-1.0/-1.0}\n" {
+		t.Errorf("wrong merge: %q", data)
+	}
+	// no counts in the brace format
+	if err := MergeResultFiles(append(files, output), output, BrcOptions{}); err == nil {
+		t.Error("expected an error for a result without counts")
+	}
+}
+
+// TestVerify checks that all threads and readers report the same lines and issues, at their offsets
+func TestVerify(t *testing.T) {
+	rng := rand.New(rand.NewPCG(49, 49))
+	valid := fuzzLines(rng, 5000, 40)
+	bad := [][]byte{[]byte("nosemi\n"), []byte(";1.0\n"), []byte("Abha;12.34\n"), []byte("Abha;x\n"),
+		[]byte("\xff\xfe;1.0\n"), append(bytes.Repeat([]byte{'u'}, 120), ";1.0\n"...), []byte("Abha;-99.9\r\n")}
+	var input []byte
+	var offsets []int64
+	for i, line := range bytes.SplitAfter(valid, []byte{'\n'}) {
+		if i%500 == 250 {
+			offsets = append(offsets, int64(len(input)))
+			input = append(input, bad[(len(offsets)-1)%len(bad)]...)
+		}
+		input = append(input, line...)
+	}
+	input = append(input, "Oslo;1.0"...) // no final \n
+	file := filepath.Join(t.TempDir(), "verify.txt")
+	os.WriteFile(file, input, 0o644)
+	var expected *VerifyReport
+	for _, reader := range BrcReaderList {
+		for _, nThreads := range []int{1, 3, 8, 64} {
+			fileReader, _ := NewFileReader(reader)
+			if err := fileReader.Open(file); err != nil {
+				t.Fatal(err)
+			}
+			report, err := Verify(fileReader, BrcOptions{ReadChunkFactor: 1, NThreads: nThreads}, VerifyOptions{MinValue: -99, MaxValue: 99})
+			fileReader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected == nil {
+				expected = report
+				continue
+			}
+			// the sums depend on the summation order
+			if math.Abs(report.Values.Sum-expected.Values.Sum) > 1e-6 {
+				t.Errorf("%s %d threads: sum of values %f, expected %f", reader, nThreads, report.Values.Sum, expected.Values.Sum)
+			}
+			report.Values.Sum = expected.Values.Sum
+			if !reflect.DeepEqual(report, expected) {
+				t.Errorf("%s %d threads: %+v, expected %+v", reader, nThreads, report, expected)
+			}
+		}
+	}
+	if expected.Lines != 5000+int64(len(offsets))+1 {
+		t.Errorf("wrong line count %d", expected.Lines)
+	}
+	// 10 bad lines: 2 without ;, 2 empty names, 2 not in the fast format, 1 not a number, then 1 of each
+	if expected.Malformed.Count != 7 || expected.LongNames.Count != 1 || expected.InvalidUTF8.Count != 1 {
+		t.Errorf("wrong issues: %+v %+v %+v", expected.Malformed, expected.LongNames, expected.InvalidUTF8)
+	}
+	if expected.Malformed.Examples[0].Offset != offsets[0] || expected.Malformed.Examples[0].Line != "nosemi" {
+		t.Errorf("wrong first malformed line: %+v at %d", expected.Malformed.Examples[0], offsets[0])
+	}
+	if expected.Values.Count != expected.Lines-7 || expected.NameLengths.Count != expected.Lines-4 {
+		t.Errorf("wrong distributions: %d values, %d names", expected.Values.Count, expected.NameLengths.Count)
+	}
+	if expected.Errors() != 8 || expected.Warnings() != expected.OutOfRange.Count+1 || expected.OutOfRange.Count == 0 {
+		t.Errorf("wrong severity: %d errors, %d warnings", expected.Errors(), expected.Warnings())
+	}
+}
+
+// TestNormalize checks the fixes, the rejects and the order of lines for all threads and readers
+func TestNormalize(t *testing.T) {
+	tmpDirPath := t.TempDir()
+	rng := rand.New(rand.NewPCG(50, 50))
+	dirty := bytes.NewBuffer(utf8BOM)
+	var expected, expectedRejects bytes.Buffer
+	for i := range 20_000 {
+		name := fmt.Sprintf("Zürich-%d", rng.IntN(500))
+		value := fmt.Sprintf("%.1f", float64(rng.IntN(1999)-999)/10)
+		fmt.Fprintf(&expected, "%s;%s\n", name, value)
+		switch i % 6 {
+		case 0:
+			fmt.Fprintf(dirty, "%s;%s\n", name, value)
+		case 1:
+			fmt.Fprintf(dirty, "%s;%s\r\n", name, value)
+		case 2:
+			fmt.Fprintf(dirty, " %s\t; %s \n", name, value)
+		case 3:
+			fmt.Fprintf(dirty, "%s;%s\n", name, strings.Replace(value, ".", ",", 1))
+		case 4:
+			fmt.Fprintf(dirty, "%s;%s0\n", name, value)
+		case 5:
+			fmt.Fprintf(dirty, "%s;%s\n\n", name, value)
+		}
+		if i%1000 == 999 {
+			offset := dirty.Len()
+			line := []string{"nosemi", ";1.0", "Abha;x", "Abha;100.0"}[i/1000%4]
+			fmt.Fprintf(dirty, "%s\n", line)
+			fmt.Fprintf(&expectedRejects, "%d\t%s\t%s\n", offset, "", line)
+		}
+	}
+	input := filepath.Join(tmpDirPath, "dirty.txt")
+	os.WriteFile(input, dirty.Bytes(), 0o644)
+	output, rejects := filepath.Join(tmpDirPath, "clean.txt"), filepath.Join(tmpDirPath, "rejects.txt")
+	for _, reader := range BrcReaderList {
+		for _, nThreads := range []int{1, 3, 64} {
+			fileReader, _ := NewFileReader(reader)
+			if err := fileReader.Open(input); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := Normalize(fileReader, output, rejects, BrcOptions{ReadChunkFactor: 1, NThreads: nThreads})
+			fileReader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// cases 1 to 4 are fixed, 3334 lines for i%6 == 1 and 3333 for the others
+			if stats.Written != 20_000 || stats.Rejected != 20 || stats.Blank != 3333 || stats.Fixed != 3334+3*3333 {
+				t.Errorf("%s %d threads: wrong stats %+v", reader, nThreads, stats)
+			}
+			if data, _ := os.ReadFile(output); !bytes.Equal(data, expected.Bytes()) {
+				t.Errorf("%s %d threads: wrong output", reader, nThreads)
+			}
+			// the reasons are not compared
+			data, _ := os.ReadFile(rejects)
+			var gotRejects bytes.Buffer
+			for _, line := range strings.SplitAfter(string(data), "\n") {
+				if fields := strings.Split(line, "\t"); len(fields) == 3 {
+					fmt.Fprintf(&gotRejects, "%s\t\t%s", fields[0], fields[2])
+				}
+			}
+			if !bytes.Equal(gotRejects.Bytes(), expectedRejects.Bytes()) {
+				t.Errorf("%s %d threads: wrong rejects %q", reader, nThreads, data)
+			}
+		}
+	}
+	data, _ := os.ReadFile(output)
+	if err := ParseLines(data, make(MapStation), MAX_KEY_SIZE); err != nil {
+		t.Error(err)
+	}
+	// values with 2 decimals, halves included, are rounded like the output: solving the normalized file
+	// gives the result of the original one, with a value per station
+	var hundredths bytes.Buffer
+	for k := -9990; k <= 9990; k += 5 {
+		fmt.Fprintf(&hundredths, "s%d;%.2f\n", k, float64(k)/100)
+	}
+	input = filepath.Join(tmpDirPath, "hundredths.txt")
+	os.WriteFile(input, hundredths.Bytes(), 0o644)
+	results := make([][]byte, 0, 2)
+	for _, number := range []BrcNumberType{BrcNumberGeneral, BrcNumberFast} {
+		fileReader := NewFileDiskReader()
+		if err := fileReader.Open(input); err != nil {
+			t.Fatal(err)
+		}
+		opts := BrcOptions{ReadChunkFactor: 1, NThreads: 3, Strategy: BrcStrategyLazyRead, ReaderType: BrcReaderDisk, Number: number}
+		if number == BrcNumberFast {
+			if _, err := Normalize(fileReader, output, "", opts); err != nil {
+				t.Fatal(err)
+			}
+			fileReader.Close()
+			fileReader = NewFileDiskReader()
+			if err := fileReader.Open(output); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result := filepath.Join(tmpDirPath, "hundredths.out")
+		err := Solve(fileReader, result, opts)
+		fileReader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(result)
+		results = append(results, data)
+	}
+	if !bytes.Equal(results[0], results[1]) {
+		t.Error("the normalized file doesn't give the result of the original one")
+	}
+}
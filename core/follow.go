@@ -0,0 +1,197 @@
+package brc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// followPoll is the default wait for appended data at the end of the file
+const followPoll = 200 * time.Millisecond
+
+// FollowOptions are how Follow waits for appended lines and refreshes the output
+type FollowOptions struct {
+	Poll      time.Duration   // wait at the end of the file before checking its size again, followPoll if 0
+	Interval  time.Duration   // rewrite the output when it is this old and lines were added, after each read if 0
+	Lines     int64           // also rewrite the output after this many new lines if > 0
+	Stop      <-chan struct{} // when closed, the lines appended until then are parsed and Follow returns
+	Refreshed func()          // if set, called after each rewrite of the output, and of opts.Metrics
+}
+
+// Follow is Solve on a file being appended to: the complete lines at start are parsed by all threads,
+// then the file is polled and only its new complete lines are parsed. The output is rewritten atomically
+// every follow.Interval or follow.Lines, until follow.Stop is closed.
+// opts.Metrics counts each rewrite as a run. The file is read from disk, without trace, shared table, spill or sampling
+func Follow(filename, file_out string, opts BrcOptions, follow FollowOptions) error {
+	opts.Metrics.start()
+	err := followFile(filename, file_out, opts, follow)
+	if err != nil {
+		opts.Metrics.end(SolveStats{}, nil, err)
+	} else {
+		opts.Metrics.stop()
+	}
+	return err
+}
+
+func followFile(filename, file_out string, opts BrcOptions, follow FollowOptions) error {
+	format, err := newLineFormat(opts)
+	if err != nil {
+		return err
+	}
+	// the size is set to the end of the last line for the first parse, and refreshed to follow the file
+	fileReader := NewFileDiskReader().(*FileDiskReader)
+	if err := fileReader.Open(filename); err != nil {
+		return err
+	}
+	defer fileReader.Close()
+	compare := stationCompareFunc(opts.Order, opts.Number != BrcNumberGeneral)
+	var workers []WorkerStats
+	write := func(stationMap MapStation, offset int64) error {
+		stats := SolveStats{Bytes: offset, Stations: len(stationMap), Workers: workers}
+		stationLst := make([]*StationData, 0, len(stationMap))
+		for _, station := range stationMap {
+			stationLst = append(stationLst, station)
+			stats.Lines += int64(station.Size)
+		}
+		slices.SortFunc(stationLst, compare)
+		timeBefore := time.Now()
+		if err := writeData(file_out, stationLst, opts.outputPrecision(), opts.Number != BrcNumberGeneral); err != nil {
+			return err
+		}
+		stats.WriteTime = time.Since(timeBefore)
+		if opts.Metrics != nil {
+			// the stations keep being updated, the metrics may be read at any time
+			snapshot := make([]StationData, len(stationLst))
+			for i, station := range stationLst {
+				snapshot[i] = *station
+				stationLst[i] = &snapshot[i]
+			}
+			opts.Metrics.refresh(stats, stationLst)
+		}
+		if follow.Refreshed != nil {
+			follow.Refreshed()
+		}
+		return nil
+	}
+	offset, err := lastLineEnd(fileReader, format)
+	if err != nil {
+		return err
+	}
+	// stations of the following reads are after those of the first parse threads for BrcOrderFirst
+	stationMap, nMaps := make(MapStation), 0
+	if offset > 0 {
+		size := fileReader.size
+		fileReader.size = offset
+		opts.Strategy = BrcStrategyLazyRead
+		var allStationMaps []MapStation
+		err := parseFile(fileReader, opts, estimateCardinality(fileReader, format, 16, 64*1024), nil, nil, &allStationMaps, &workers)
+		fileReader.size = size
+		if err != nil {
+			return err
+		}
+		var stationLst []*StationData
+		mergeMapsSequential(allStationMaps, &stationLst, compare)
+		stationMap, nMaps = allStationMaps[0], len(allStationMaps)
+	} else if hasBOM(fileReader) {
+		offset = int64(len(utf8BOM))
+	}
+	if err := write(stationMap, offset); err != nil {
+		return err
+	}
+	if follow.Poll <= 0 {
+		follow.Poll = followPoll
+	}
+	readMap := make(MapStation)
+	buff := make([]byte, max(int64(opts.ReadChunkFactor*os.Getpagesize()), 2*format.maxSize))
+	var firstBase, newLines int64
+	lastWrite := time.Now()
+	for {
+		// the lines appended before the stop are parsed and written
+		stopping := false
+		select {
+		case <-follow.Stop:
+			stopping = true
+		default:
+		}
+		size, err := fileReader.refreshSize()
+		if err != nil {
+			return err
+		}
+		if size < offset {
+			return fmt.Errorf("%s was truncated to %d bytes, %d were parsed", filename, size, offset)
+		}
+		partial := false
+		for offset < size {
+			n, err := fileReader.ReadChunk(buff[:min(int64(len(buff)), size-offset)], offset)
+			if err != nil {
+				return err
+			}
+			end := int64(bytes.LastIndexByte(buff[:n], '\n'))
+			if end < 0 {
+				if n >= format.maxSize {
+					return format.lineSizeError(offset)
+				}
+				partial = true // the last line is not complete yet
+				break
+			}
+			if err := format.parse(buff[:end+1], readMap, nil); err != nil {
+				return err
+			}
+			offset += end + 1
+			for key, station := range readMap {
+				station.First = int64(nMaps)<<firstThreadShift | (firstBase + station.First)
+				newLines += int64(station.Size)
+				if v, ok := stationMap[key]; ok {
+					mergeStation(v, station)
+				} else {
+					stationMap[key] = station
+				}
+			}
+			firstBase += int64(len(readMap))
+			clear(readMap)
+			if !stopping && follow.Lines > 0 && newLines >= follow.Lines {
+				break
+			}
+		}
+		if newLines > 0 && (stopping || time.Since(lastWrite) >= follow.Interval || (follow.Lines > 0 && newLines >= follow.Lines)) {
+			if err := write(stationMap, offset); err != nil {
+				return err
+			}
+			if opts.Verbose {
+				fmt.Printf("Followed %d new lines, %d stations, %d bytes parsed\n", newLines, len(stationMap), offset)
+			}
+			newLines, lastWrite = 0, time.Now()
+		}
+		if stopping {
+			return nil
+		}
+		if offset < size && !partial { // more to read
+			continue
+		}
+		select {
+		case <-follow.Stop:
+		case <-time.After(follow.Poll):
+		}
+	}
+}
+
+// lastLineEnd returns the size of the complete lines of the file, the last one may be being written
+func lastLineEnd(fileReader FileReader, format *lineFormat) (int64, error) {
+	size := fileReader.GetSize()
+	start := max(0, size-format.maxSize)
+	buff := make([]byte, size-start)
+	n, err := fileReader.ReadChunk(buff, start)
+	if err != nil {
+		return 0, err
+	}
+	end := int64(bytes.LastIndexByte(buff[:n], '\n'))
+	switch {
+	case end >= 0:
+		return start + end + 1, nil
+	case start > 0:
+		return 0, format.lineSizeError(start)
+	}
+	return 0, nil
+}
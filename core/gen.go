@@ -0,0 +1,235 @@
+package brc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const genBlockRows = 1 << 20 // rows per block, each block has its own seeded generator
+
+type GenStation struct {
+	Name   string
+	Mean   float64
+	StdDev float64
+}
+
+type GenOptions struct {
+	Rows       int64        // number of lines to write
+	Seed       uint64       // same seed and options => same file, whatever NThreads
+	Stations   []GenStation // DefaultGenStations if empty
+	UniqueKeys int          // if > 0, use id1..idN names, means taken from Stations
+	EdgeCases  bool         // inject long utf8 names and -99.9/99.9/0.0 values
+	NThreads   int          // number of blocks generated in parallel
+}
+
+// genEdgeNames are the longest (100 bytes) and shortest names, with 2, 3 and 4 bytes utf8 chars
+var genEdgeNames = []string{
+	strings.Repeat("é", 50),
+	strings.Repeat("€", 33) + "x",
+	strings.Repeat("🐝", 25),
+	"A",
+}
+
+var genEdgeValues = []int{-999, 999, 0, -1, 1}
+
+// genAgg is an exact aggregate, values are in tenth of degrees
+type genAgg struct {
+	min, max int
+	sum      int64
+	count    int64
+}
+
+func (agg *genAgg) add(value int) {
+	if agg.count == 0 || value < agg.min {
+		agg.min = value
+	}
+	if agg.count == 0 || value > agg.max {
+		agg.max = value
+	}
+	agg.sum += int64(value)
+	agg.count++
+}
+
+func (agg *genAgg) merge(other genAgg) {
+	if other.count == 0 {
+		return
+	}
+	if agg.count == 0 {
+		*agg = other
+		return
+	}
+	agg.min = min(agg.min, other.min)
+	agg.max = max(agg.max, other.max)
+	agg.sum += other.sum
+	agg.count += other.count
+}
+
+// LoadGenStations reads a station list, one "name;mean[;stddev]" per line, stddev defaults to defaultStdDev
+func LoadGenStations(filename string, defaultStdDev float64) ([]GenStation, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var stations []GenStation
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		station := GenStation{Name: fields[0], StdDev: defaultStdDev}
+		if len(fields) < 2 || len(fields) > 3 || len(station.Name) == 0 || len(station.Name) > 100 {
+			return nil, fmt.Errorf("%s:%d: expected name;mean[;stddev]", filename, i+1)
+		}
+		if station.Mean, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid mean: %v", filename, i+1, err)
+		}
+		if len(fields) == 3 {
+			if station.StdDev, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid stddev: %v", filename, i+1, err)
+			}
+		}
+		stations = append(stations, station)
+	}
+	if len(stations) == 0 {
+		return nil, fmt.Errorf("%s: no station", filename)
+	}
+	return stations, nil
+}
+
+// genKeys returns the names and distributions of all keys, followed by the edge case names
+func genKeys(opts GenOptions) ([]string, []GenStation) {
+	stations := opts.Stations
+	if len(stations) == 0 {
+		stations = DefaultGenStations
+	}
+	var names []string
+	if opts.UniqueKeys > 0 {
+		keys := make([]GenStation, opts.UniqueKeys)
+		for i := range keys {
+			keys[i] = stations[i%len(stations)]
+			names = append(names, "id"+strconv.Itoa(i+1))
+		}
+		stations = keys
+	} else {
+		for _, station := range stations {
+			names = append(names, station.Name)
+		}
+	}
+	if opts.EdgeCases {
+		names = append(names, genEdgeNames...)
+	}
+	return names, stations
+}
+
+// appendTenth renders a value in tenth of degrees with exactly one decimal
+func appendTenth(buf []byte, value int) []byte {
+	if value < 0 {
+		buf = append(buf, '-')
+		value = -value
+	}
+	buf = strconv.AppendInt(buf, int64(value/10), 10)
+	return append(buf, '.', byte('0'+value%10))
+}
+
+// genBlock writes the rows [first, first+n) of block blockId in buf and aggregates them in aggs
+func genBlock(opts GenOptions, names []string, stations []GenStation, blockId, first, n int64, buf []byte, aggs []genAgg) []byte {
+	rng := rand.New(rand.NewPCG(opts.Seed, uint64(blockId)))
+	for row := first; row < first+n; row++ {
+		var key, value int
+		if opts.EdgeCases && row%1000 == 0 {
+			// every 1000 rows, an edge case name with an edge case value
+			key = len(stations) + rng.IntN(len(genEdgeNames))
+			value = genEdgeValues[rng.IntN(len(genEdgeValues))]
+		} else {
+			key = rng.IntN(len(stations))
+			temp := rng.NormFloat64()*stations[key].StdDev + stations[key].Mean
+			value = int(math.Round(max(-99.9, min(99.9, temp)) * 10))
+		}
+		buf = append(buf, names[key]...)
+		buf = append(buf, ';')
+		buf = appendTenth(buf, value)
+		buf = append(buf, '\n')
+		aggs[key].add(value)
+	}
+	return buf
+}
+
+// Generate writes opts.Rows measurements in fileOut and the expected result in expectedOut (if not empty).
+// Rows are generated by blocks of genBlockRows in parallel, and written in order
+func Generate(fileOut, expectedOut string, opts GenOptions) error {
+	if opts.Rows < 0 {
+		return fmt.Errorf("rows must be positive")
+	}
+	names, stations := genKeys(opts)
+	nThreads := max(opts.NThreads, 1)
+	outFs, err := os.Create(fileOut)
+	if err != nil {
+		return err
+	}
+	defer outFs.Close()
+	writer := bufio.NewWriterSize(outFs, 1024*1024)
+	nBlocks := (opts.Rows + genBlockRows - 1) / genBlockRows
+	buffers := make([][]byte, nThreads)
+	aggs := make([][]genAgg, nThreads)
+	total := make([]genAgg, len(names))
+	for i := range nThreads {
+		aggs[i] = make([]genAgg, len(names))
+	}
+	for roundStart := int64(0); roundStart < nBlocks; roundStart += int64(nThreads) {
+		var wg sync.WaitGroup
+		for i := range int(min(int64(nThreads), nBlocks-roundStart)) {
+			blockId := roundStart + int64(i)
+			first := blockId * genBlockRows
+			wg.Go(func() {
+				buffers[i] = genBlock(opts, names, stations, blockId, first,
+					min(genBlockRows, opts.Rows-first), buffers[i][:0], aggs[i])
+			})
+		}
+		wg.Wait()
+		for i := range int(min(int64(nThreads), nBlocks-roundStart)) {
+			if _, err := writer.Write(buffers[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if len(expectedOut) == 0 {
+		return outFs.Close()
+	}
+	for i := range aggs {
+		for key, agg := range aggs[i] {
+			total[key].merge(agg)
+		}
+	}
+	stationLst := make([]*StationData, 0, len(names))
+	for key, agg := range total {
+		if agg.count == 0 {
+			continue
+		}
+		stationLst = append(stationLst, &StationData{
+			Name: []byte(names[key]),
+			Min:  float64(agg.min) / 10,
+			Max:  float64(agg.max) / 10,
+			Sum:  float64(agg.sum) / 10,
+			Size: int(agg.count),
+		})
+	}
+	slices.SortFunc(stationLst, func(a *StationData, b *StationData) int {
+		return bytes.Compare(a.Name, b.Name)
+	})
+	if err := writeData(expectedOut, stationLst, 1, true); err != nil {
+		return err
+	}
+	return outFs.Close()
+}
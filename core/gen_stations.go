@@ -0,0 +1,20 @@
+package brc
+
+// DefaultGenStations is a subset of the upstream create_measurements.py stations, mean temperatures in °C
+var DefaultGenStations = []GenStation{
+	{"Abha", 18.0, 10}, {"Abidjan", 26.0, 10}, {"Abéché", 29.4, 10}, {"Accra", 26.4, 10},
+	{"Addis Ababa", 16.0, 10}, {"Adelaide", 17.3, 10}, {"Aden", 29.1, 10}, {"Ahvaz", 25.4, 10},
+	{"Albuquerque", 14.0, 10}, {"Alexandra", 11.0, 10}, {"Alexandria", 20.0, 10}, {"Algiers", 18.2, 10},
+	{"Alice Springs", 21.0, 10}, {"Almaty", 10.0, 10}, {"Amsterdam", 10.2, 10}, {"Anadyr", -6.9, 10},
+	{"Anchorage", 2.8, 10}, {"Andorra la Vella", 9.8, 10}, {"Ankara", 12.0, 10}, {"Antananarivo", 17.9, 10},
+	{"Arkhangelsk", 1.3, 10}, {"Ashgabat", 17.1, 10}, {"Asmara", 15.6, 10}, {"Astana", 3.5, 10},
+	{"Athens", 19.2, 10}, {"Atlanta", 17.0, 10}, {"Auckland", 15.2, 10}, {"Austin", 20.7, 10},
+	{"Baghdad", 22.8, 10}, {"Baku", 15.1, 10}, {"Bamako", 27.8, 10}, {"Bangkok", 28.6, 10},
+	{"Barcelona", 18.2, 10}, {"Beijing", 12.9, 10}, {"Beirut", 20.9, 10}, {"Belgrade", 12.5, 10},
+	{"Berlin", 10.3, 10}, {"Bosaso", 30.0, 10}, {"Brazzaville", 25.0, 10}, {"Bulawayo", 18.9, 10},
+	{"Cairo", 21.4, 10}, {"Canberra", 13.1, 10}, {"Chihuahua", 18.6, 10}, {"Da Nang", 25.8, 10},
+	{"Dikson", -11.1, 10}, {"Dunedin", 11.1, 10}, {"Edinburgh", 9.3, 10}, {"Hamburg", 9.7, 10},
+	{"Ho Chi Minh City", 27.4, 10}, {"İzmir", 17.9, 10}, {"Kraków", 8.3, 10}, {"Lhasa", 7.6, 10},
+	{"Odesa", 10.7, 10}, {"Petropavlovsk-Kamchatsky", 1.9, 10}, {"Reykjavík", 4.3, 10}, {"São Paulo", 19.7, 10},
+	{"Tamanrasset", 21.7, 10}, {"Xi'an", 14.1, 10}, {"Yellowknife", -4.3, 10}, {"Zürich", 9.3, 10},
+}
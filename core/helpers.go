@@ -40,33 +40,56 @@ func findIndexOf(haystack []byte, pattern uint64) int {
 	if hLen%8 == 0 {
 		return -1
 	}
+	if index := firstInstance(loadTail(haystack[i:]), pattern); index != 8 {
+		return i + index
+	}
+	return -1
+}
+
+// findSeparator is findIndexOf for the first ; or \n, in a single pass
+func findSeparator(haystack []byte) int {
+	var i int
+	hLen := len(haystack)
+	for i = 0; i < hLen/8*8; i += 8 {
+		if index := firstSeparator(binary.BigEndian.Uint64(haystack[i : i+8])); index != 8 {
+			return i + index
+		}
+	}
+	if hLen%8 == 0 {
+		return -1
+	}
+	if index := firstSeparator(loadTail(haystack[i:])); index != 8 {
+		return i + index
+	}
+	return -1
+}
+
+// loadTail loads the last 1 to 7 bytes of a haystack as the start of a big endian word, zero padded
+func loadTail(tail []byte) uint64 {
 	sliceToUint := uint64(0)
-	switch hLen % 8 {
+	switch len(tail) {
 	case 7:
-		sliceToUint |= (uint64(haystack[i+6]) << 8)
+		sliceToUint |= (uint64(tail[6]) << 8)
 		fallthrough
 	case 6:
-		sliceToUint |= (uint64(haystack[i+5]) << 16)
+		sliceToUint |= (uint64(tail[5]) << 16)
 		fallthrough
 	case 5:
-		sliceToUint |= (uint64(haystack[i+4]) << 24)
+		sliceToUint |= (uint64(tail[4]) << 24)
 		fallthrough
 	case 4:
-		sliceToUint |= (uint64(haystack[i+3]) << 32)
+		sliceToUint |= (uint64(tail[3]) << 32)
 		fallthrough
 	case 3:
-		sliceToUint |= (uint64(haystack[i+2]) << 40)
+		sliceToUint |= (uint64(tail[2]) << 40)
 		fallthrough
 	case 2:
-		sliceToUint |= (uint64(haystack[i+1]) << 48)
+		sliceToUint |= (uint64(tail[1]) << 48)
 		fallthrough
 	case 1:
-		sliceToUint |= (uint64(haystack[i]) << 56)
+		sliceToUint |= (uint64(tail[0]) << 56)
 	}
-	if index := firstInstance(sliceToUint, pattern); index != 8 {
-		return i + index
-	}
-	return -1
+	return sliceToUint
 }
 
 // https://richardstartin.github.io/posts/finding-bytes
@@ -83,35 +106,46 @@ func compilePattern(byteToFind byte) uint64 {
 }
 
 func firstInstance(word, pattern uint64) int {
+	return bits.LeadingZeros64(instanceMask(word, pattern)) >> 3
+}
+
+// firstSeparator is firstInstance for ; or \n
+func firstSeparator(word uint64) int {
+	return bits.LeadingZeros64(instanceMask(word, patternSemi)|instanceMask(word, patternNl)) >> 3
+}
+
+// instanceMask sets the high bit of the bytes of word equal to the byte of pattern
+func instanceMask(word, pattern uint64) uint64 {
 	var input uint64 = word ^ pattern
 	var tmp uint64 = (input & 0x7F7F7F7F7F7F7F7F) + 0x7F7F7F7F7F7F7F7F
-	tmp = ^(tmp | input | 0x7F7F7F7F7F7F7F7F)
-	return bits.LeadingZeros64(tmp) >> 3
+	return ^(tmp | input | 0x7F7F7F7F7F7F7F7F)
 }
 
-// ParseF64, over simplified. We only need to parse -99.9 to 99.9 float, input is always valid
+// ParseF64, over simplified. We only need to parse -99.9 to 99.9 float, input is always valid.
+// Nothing after the first decimal is read, so a \r of a CRLF line is ignored.
+// An invalid value doesn't panic, the digits read until then are returned
 // Taken from https://github.com/valyala/fastjson/blob/6dae91c8e11a7fa6a257a550b75cba53ab81693e/fastfloat/parse.go#L203
 // Faster than std strconv.ParseFloat
 func ParseF64(s []byte) float64 {
 	var f float64
 	i := 0
 	d := 0
-	minus := s[0] == '-'
+	minus := len(s) > 0 && s[0] == '-'
 	if minus {
 		i++
 	}
-	if s[i] >= '0' && s[i] <= '9' {
+	if i < len(s) && s[i] >= '0' && s[i] <= '9' {
 		d = d*10 + int(s[i]-'0')
 		i++
 	}
-	if s[i] >= '0' && s[i] <= '9' {
+	if i < len(s) && s[i] >= '0' && s[i] <= '9' {
 		d = d*10 + int(s[i]-'0')
 		i++
 	}
-	if s[i] == '.' {
+	if i < len(s) && s[i] == '.' {
 		i++
 		k := i
-		if s[i] >= '0' && s[i] <= '9' {
+		if i < len(s) && s[i] >= '0' && s[i] <= '9' {
 			d = d*10 + int(s[i]-'0')
 			i++
 		}
@@ -130,4 +164,5 @@ func ParseF64(s []byte) float64 {
 // This works faster than math.Pow10, since it avoids additional multiplication.
 var float64pow10 = [...]float64{
 	1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15,
+	1e16, 1e17, 1e18, 1e19, 1e20, 1e21, 1e22,
 }
@@ -0,0 +1,90 @@
+package brc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// stationMemSize is the estimated cost of one station in a MapStation:
+// map entry + StationData + an average name
+const stationMemSize = 160
+
+// memoryBudget tracks the estimated memory used by all workers.
+// A nil *memoryBudget is unlimited
+type memoryBudget struct {
+	limit    int64
+	used     atomic.Int64
+	stations atomic.Int64
+	exceeded atomic.Bool
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit}
+}
+
+// grow adds n bytes to the budget, returns false when the budget is exceeded
+func (budget *memoryBudget) grow(n int64) bool {
+	if budget == nil {
+		return true
+	}
+	if budget.used.Add(n) > budget.limit {
+		budget.exceeded.Store(true)
+	}
+	return !budget.exceeded.Load()
+}
+
+// growStations adds n new stations to the budget, returns false when the budget is exceeded
+func (budget *memoryBudget) growStations(n int) bool {
+	if budget == nil {
+		return true
+	}
+	budget.stations.Add(int64(n))
+	return budget.grow(int64(n) * stationMemSize)
+}
+
+func (budget *memoryBudget) err() error {
+	if budget == nil || !budget.exceeded.Load() {
+		return nil
+	}
+	return fmt.Errorf("Memory budget of %s exceeded: %s estimated for %d stations in all thread maps",
+		FormatByteSize(budget.limit), FormatByteSize(budget.used.Load()), budget.stations.Load())
+}
+
+var byteSizeUnits = []string{"", "K", "M", "G", "T"}
+
+// ParseByteSize parses a size like 512, 64K, 512M or 2G (powers of 1024, optional B suffix)
+func ParseByteSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	factor := int64(1)
+	for i := len(byteSizeUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(str, byteSizeUnits[i]) {
+			str = strings.TrimSuffix(str, byteSizeUnits[i])
+			factor = int64(1) << (10 * i)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %q", s)
+	}
+	return n * factor, nil
+}
+
+// FormatByteSize is the reverse of ParseByteSize, rounded to the biggest unit
+func FormatByteSize(n int64) string {
+	i := 0
+	f := float64(n)
+	for f >= 1024 && i < len(byteSizeUnits)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%sB", f, byteSizeUnits[i])
+}
@@ -0,0 +1,116 @@
+package brc
+
+import (
+	"container/heap"
+	"slices"
+	"sync"
+	"time"
+)
+
+// parallelMergeMin is the number of stations (sum of all maps) from which mergeMaps uses partitions
+const parallelMergeMin = 1 << 16
+
+type keyedStation struct {
+	key     uint64
+	station *StationData
+}
+
+// mergeMapsPartitioned splits the keys of each map by hash, one partition per map, in parallel.
+// Each partition is then merged and sorted by its own goroutine, and a k-way merge builds stationLst.
+// If workers is set, the split of map i and the merge of partition i are traced as spans of worker i
+func mergeMapsPartitioned(allStationMaps []MapStation, stationLst *[]*StationData, compare func(a, b *StationData) int, workers []WorkerStats) {
+	nParts := len(allStationMaps)
+	addSpan := func(i int, name string, start time.Time) {
+		if workers != nil {
+			workers[i].addSpan(name, start)
+		}
+	}
+	// buckets[i][p] are the stations of map i in partition p
+	buckets := make([][][]keyedStation, len(allStationMaps))
+	var wg sync.WaitGroup
+	for i, stationMap := range allStationMaps {
+		wg.Go(func() {
+			defer addSpan(i, "merge split", time.Now())
+			buckets[i] = make([][]keyedStation, nParts)
+			for p := range buckets[i] {
+				buckets[i][p] = make([]keyedStation, 0, len(stationMap)/nParts+len(stationMap)/(4*nParts)+1)
+			}
+			for key, station := range stationMap {
+				station.First |= int64(i) << firstThreadShift
+				p := key % uint64(nParts)
+				buckets[i][p] = append(buckets[i][p], keyedStation{key, station})
+			}
+		})
+	}
+	wg.Wait()
+	parts := make([][]*StationData, nParts)
+	for p := range parts {
+		wg.Go(func() {
+			defer addSpan(p, "merge", time.Now())
+			size := 0
+			for i := range buckets {
+				size = max(size, len(buckets[i][p]))
+			}
+			merged := make(map[uint64]*StationData, size)
+			part := make([]*StationData, 0, size)
+			// maps in thread order, so First of the first seen is already the lowest
+			for i := range buckets {
+				for _, s := range buckets[i][p] {
+					v, ok := merged[s.key]
+					if !ok {
+						merged[s.key] = s.station
+						part = append(part, s.station)
+					} else {
+						mergeStation(v, s.station)
+					}
+				}
+				buckets[i][p] = nil
+			}
+			slices.SortFunc(part, compare)
+			parts[p] = part
+		})
+	}
+	wg.Wait()
+	*stationLst = mergeSorted(*stationLst, parts, compare)
+}
+
+// mergeSorted appends the sorted parts to dst in order, with a heap of the heads of the parts
+func mergeSorted(dst []*StationData, parts [][]*StationData, compare func(a, b *StationData) int) []*StationData {
+	h := &partsHeap{compare: compare}
+	total := 0
+	for _, part := range parts {
+		if len(part) > 0 {
+			h.parts = append(h.parts, part)
+			total += len(part)
+		}
+	}
+	dst = slices.Grow(dst, total)
+	heap.Init(h)
+	for h.Len() > 0 {
+		part := h.parts[0]
+		dst = append(dst, part[0])
+		if len(part) == 1 {
+			heap.Pop(h)
+		} else {
+			h.parts[0] = part[1:]
+			heap.Fix(h, 0)
+		}
+	}
+	return dst
+}
+
+// partsHeap is a container/heap of sorted parts, by their first station
+type partsHeap struct {
+	parts   [][]*StationData
+	compare func(a, b *StationData) int
+}
+
+func (h *partsHeap) Len() int           { return len(h.parts) }
+func (h *partsHeap) Less(i, j int) bool { return h.compare(h.parts[i][0], h.parts[j][0]) < 0 }
+func (h *partsHeap) Swap(i, j int)      { h.parts[i], h.parts[j] = h.parts[j], h.parts[i] }
+func (h *partsHeap) Push(x any)         { h.parts = append(h.parts, x.([]*StationData)) }
+func (h *partsHeap) Pop() any {
+	last := h.parts[len(h.parts)-1]
+	h.parts = h.parts[:len(h.parts)-1]
+	return last
+}
@@ -0,0 +1,165 @@
+package brc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// RunMetrics collects the metrics of Solve runs, set BrcOptions.Metrics to fill it.
+// It can be written in the OpenMetrics text format at any time, even during a run
+type RunMetrics struct {
+	mu         sync.Mutex
+	running    bool
+	progress   atomic.Int64 // bytes read by the current run
+	runs       int64
+	errors     int64
+	lastRun    time.Time
+	lastErr    error
+	stats      SolveStats
+	stations   []*StationData
+	perStation bool
+}
+
+// NewRunMetrics returns empty metrics, perStation adds min/mean/max/count gauges of each station
+func NewRunMetrics(perStation bool) *RunMetrics {
+	return &RunMetrics{perStation: perStation}
+}
+
+func (metrics *RunMetrics) start() {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.running = true
+	metrics.progress.Store(0)
+}
+
+func (metrics *RunMetrics) end(stats SolveStats, stationLst []*StationData, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.running = false
+	metrics.runs++
+	metrics.lastRun = time.Now()
+	metrics.lastErr = err
+	if err != nil {
+		metrics.errors++
+		return
+	}
+	metrics.stats = stats
+	metrics.stations = stationLst
+}
+
+// refresh records the output of a run still in progress: Follow counts each rewrite of its output as a run
+func (metrics *RunMetrics) refresh(stats SolveStats, stationLst []*StationData) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.runs++
+	metrics.lastRun = time.Now()
+	metrics.lastErr = nil
+	metrics.stats = stats
+	metrics.stations = stationLst
+	metrics.progress.Store(stats.Bytes)
+}
+
+// stop ends a run whose output was recorded by refresh
+func (metrics *RunMetrics) stop() {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.running = false
+}
+
+// escapeLabel escapes a label value: \, " and \n
+func escapeLabel(value []byte) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(string(value))
+}
+
+// WriteTo writes all metrics in the OpenMetrics text format
+func (metrics *RunMetrics) WriteTo(w io.Writer) (int64, error) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	var out bytes.Buffer
+	family := func(name, kind, help string) {
+		fmt.Fprintf(&out, "# TYPE %s %s\n# HELP %s %s\n", name, kind, name, help)
+	}
+	boolToInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	family("brc_running", "gauge", "1 while a run is in progress.")
+	fmt.Fprintf(&out, "brc_running %d\n", boolToInt(metrics.running))
+	family("brc_progress_bytes", "gauge", "Bytes read by the current or last run.")
+	fmt.Fprintf(&out, "brc_progress_bytes %d\n", metrics.progress.Load())
+	family("brc_runs", "counter", "Finished runs.")
+	fmt.Fprintf(&out, "brc_runs_total %d\n", metrics.runs)
+	family("brc_errors", "counter", "Failed runs.")
+	fmt.Fprintf(&out, "brc_errors_total %d\n", metrics.errors)
+	if metrics.runs > 0 {
+		family("brc_last_run_timestamp_seconds", "gauge", "End of the last run.")
+		fmt.Fprintf(&out, "brc_last_run_timestamp_seconds %.3f\n", float64(metrics.lastRun.UnixMilli())/1e3)
+		family("brc_last_run_success", "gauge", "1 if the last run succeeded.")
+		fmt.Fprintf(&out, "brc_last_run_success %d\n", boolToInt(metrics.lastErr == nil))
+	}
+	if metrics.runs > metrics.errors { // at least one successful run
+		stats := metrics.stats
+		family("brc_phase_duration_seconds", "gauge", "Duration of each phase of the last successful run.")
+		for _, phase := range []struct {
+			name string
+			dur  time.Duration
+		}{{"read", stats.ReadTime}, {"parse", stats.ParseTime}, {"merge", stats.MergeTime}, {"write", stats.WriteTime}} {
+			fmt.Fprintf(&out, "brc_phase_duration_seconds{phase=\"%s\"} %g\n", phase.name, phase.dur.Seconds())
+		}
+		family("brc_input_bytes", "gauge", "Input size of the last successful run.")
+		fmt.Fprintf(&out, "brc_input_bytes %d\n", stats.Bytes)
+		family("brc_lines", "gauge", "Lines parsed by the last successful run.")
+		fmt.Fprintf(&out, "brc_lines %d\n", stats.Lines)
+		family("brc_stations", "gauge", "Unique stations of the last successful run.")
+		fmt.Fprintf(&out, "brc_stations %d\n", stats.Stations)
+		family("brc_threads", "gauge", "Threads used by the last successful run.")
+		fmt.Fprintf(&out, "brc_threads %d\n", len(stats.Workers))
+	}
+	if metrics.perStation && len(metrics.stations) > 0 {
+		for _, gauge := range []struct {
+			name, help string
+			value      func(station *StationData) float64
+		}{
+			{"brc_station_min", "Min measurement of the station.", func(s *StationData) float64 { return s.Min }},
+			{"brc_station_mean", "Mean measurement of the station.", func(s *StationData) float64 { return s.Sum / float64(s.Size) }},
+			{"brc_station_max", "Max measurement of the station.", func(s *StationData) float64 { return s.Max }},
+			{"brc_station_measurements", "Number of measurements of the station.", func(s *StationData) float64 { return float64(s.Size) }},
+		} {
+			family(gauge.name, "gauge", gauge.help)
+			for _, station := range metrics.stations {
+				fmt.Fprintf(&out, "%s{station=\"%s\"} %g\n", gauge.name, escapeLabel(station.Name), gauge.value(station))
+			}
+		}
+	}
+	fmt.Fprintf(&out, "# EOF\n")
+	n, err := w.Write(out.Bytes())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, to be used as a /metrics handler
+func (metrics *RunMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", OpenMetricsContentType)
+	metrics.WriteTo(w)
+}
@@ -0,0 +1,217 @@
+package brc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// NormalizeStats counts the lines of Normalize
+type NormalizeStats struct {
+	Lines    int64 `json:"lines"`
+	Written  int64 `json:"written"`
+	Fixed    int64 `json:"fixed"`    // written lines different from the input line
+	Rejected int64 `json:"rejected"` // unfixable lines, in the rejects file if any
+	Blank    int64 `json:"blank"`    // dropped
+}
+
+func (stats *NormalizeStats) merge(other NormalizeStats) {
+	stats.Lines += other.Lines
+	stats.Written += other.Written
+	stats.Fixed += other.Fixed
+	stats.Rejected += other.Rejected
+	stats.Blank += other.Blank
+}
+
+// normalizePart is the output of a thread, in temporary files concatenated in thread order
+type normalizePart struct {
+	out, rejects   *os.File
+	outW, rejectsW *bufio.Writer
+	stats          NormalizeStats
+	err            error
+}
+
+func newNormalizePart(dir string, withRejects bool) (*normalizePart, error) {
+	part := &normalizePart{}
+	var err error
+	if part.out, err = os.CreateTemp(dir, ".brc-normalize.*.part"); err != nil {
+		return nil, err
+	}
+	part.outW = bufio.NewWriter(part.out)
+	if withRejects {
+		if part.rejects, err = os.CreateTemp(dir, ".brc-rejects.*.part"); err != nil {
+			part.remove()
+			return nil, err
+		}
+		part.rejectsW = bufio.NewWriter(part.rejects)
+	}
+	return part, nil
+}
+
+func (part *normalizePart) remove() {
+	for _, file := range []*os.File{part.out, part.rejects} {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+}
+
+// reject counts the line, and writes OFFSET\tREASON\tLINE in the rejects part
+func (part *normalizePart) reject(offset int64, line []byte, reason string) {
+	part.stats.Rejected++
+	if part.rejectsW != nil {
+		fmt.Fprintf(part.rejectsW, "%d\t%s\t", offset, reason)
+		part.rejectsW.Write(line)
+		part.rejectsW.WriteByte('\n')
+	}
+}
+
+// Normalize rewrites the file in the name;d.d\n form accepted by ParseLines: no BOM, LF line endings, names and
+// values trimmed, decimal commas replaced and values rounded to one decimal. Blank lines are dropped, lines that
+// can't be fixed too, and written in rejects if it is not empty, after their offset and reason.
+// Threads normalize the ranges of parseFile in part files, concatenated in order in the outputs
+func Normalize(fileReader FileReader, file_out, rejects string, opts BrcOptions) (NormalizeStats, error) {
+	var stats NormalizeStats
+	format, err := newLineFormat(opts)
+	if err != nil {
+		return stats, err
+	}
+	dir := filepath.Dir(file_out)
+	if file_out == StdoutPath {
+		dir = os.TempDir()
+	}
+	ranges, chunk_size := lineRanges(fileReader.GetSize(), opts, format)
+	parts := make([]*normalizePart, 0, len(ranges))
+	defer func() {
+		for _, part := range parts {
+			part.remove()
+		}
+	}()
+	for range ranges {
+		part, err := newNormalizePart(dir, len(rejects) > 0)
+		if err != nil {
+			return stats, fmt.Errorf("Cannot create output %s: %w", file_out, err)
+		}
+		parts = append(parts, part)
+	}
+	var wg sync.WaitGroup
+	for t_i, lines := range ranges {
+		wg.Go(func() {
+			part := parts[t_i]
+			var value, out []byte
+			part.err = scanLines(fileReader, lines, chunk_size, format, func(line []byte, offset int64, tooLong bool) {
+				part.stats.Lines++
+				if tooLong {
+					part.reject(offset, line[:format.maxSize], fmt.Sprintf("longer than the max line size %d", format.maxSize))
+					return
+				}
+				name, reason := normalizeLine(line, format, &value)
+				switch {
+				case len(reason) > 0:
+					part.reject(offset, line, reason)
+				case name == nil:
+					part.stats.Blank++
+				default:
+					out = append(append(append(out[:0], name...), ';'), value...)
+					part.stats.Written++
+					if !bytes.Equal(out, line) {
+						part.stats.Fixed++
+					}
+					part.outW.Write(append(out, '\n'))
+				}
+			})
+			if err := part.outW.Flush(); part.err == nil {
+				part.err = err
+			}
+			if part.rejectsW != nil {
+				if err := part.rejectsW.Flush(); part.err == nil {
+					part.err = err
+				}
+			}
+		})
+	}
+	wg.Wait()
+	for _, part := range parts {
+		if part.err != nil {
+			return stats, part.err
+		}
+		stats.merge(part.stats)
+	}
+	if err := concatParts(file_out, parts, func(part *normalizePart) *os.File { return part.out }); err != nil {
+		return stats, err
+	}
+	if len(rejects) > 0 {
+		if err := concatParts(rejects, parts, func(part *normalizePart) *os.File { return part.rejects }); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// concatParts writes the file of each part in order to path
+func concatParts(path string, parts []*normalizePart, file func(part *normalizePart) *os.File) error {
+	out, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	defer out.abort()
+	for _, part := range parts {
+		if _, err := file(part).Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, file(part)); err != nil {
+			return err
+		}
+	}
+	return out.commit()
+}
+
+// normalizeLine returns the trimmed name of a line without its \n, and sets value to its one decimal value.
+// Returns a nil name for a blank line, and the reason of a line that can't be normalized
+func normalizeLine(line []byte, format *lineFormat, value *[]byte) ([]byte, string) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, ""
+	}
+	sep := bytes.IndexByte(line, ';')
+	if sep < 0 {
+		return nil, "no ';'"
+	}
+	name, raw := bytes.TrimSpace(line[:sep]), bytes.TrimSpace(line[sep+1:])
+	switch {
+	case len(name) == 0:
+		return nil, "empty name"
+	case len(name) > format.maxKeySize:
+		return nil, fmt.Sprintf("name of %d bytes, over the max key size %d", len(name), format.maxKeySize)
+	case !utf8.Valid(name):
+		return nil, "name is not valid UTF-8"
+	}
+	*value = append((*value)[:0], raw...)
+	if comma := bytes.IndexByte(*value, ','); comma >= 0 && bytes.Count(*value, []byte{','}) == 1 && bytes.IndexByte(*value, '.') < 0 {
+		(*value)[comma] = '.'
+	}
+	number := math.NaN()
+	if len(*value) > 0 {
+		number = ParseNumber(*value)
+	}
+	if math.IsNaN(number) {
+		return nil, "value is not a number"
+	}
+	// rounded like the output, solving the normalized file gives the same result
+	*value = strconv.AppendFloat((*value)[:0], roundDecimals(number, 10), 'f', 1, 64)
+	if string(*value) == "-0.0" {
+		*value = append((*value)[:0], "0.0"...)
+	}
+	if !isFastValue(*value) {
+		return nil, "value out of the fast format (-99.9 to 99.9)"
+	}
+	return name, ""
+}
@@ -0,0 +1,134 @@
+package brc
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+type BrcNumberType string
+
+const (
+	BrcNumberFast    BrcNumberType = "fast"    // -99.9 to 99.9 with one decimal, ParseF64
+	BrcNumberGeneral BrcNumberType = "general" // any decimal number, ParseNumber
+)
+
+var BrcNumberList = []BrcNumberType{BrcNumberFast, BrcNumberGeneral}
+
+// BrcPrecisionInteger is the BrcOptions.Precision for values without decimals (0 means the default, 1)
+const BrcPrecisionInteger = -1
+
+// ParseLinesGeneral is ParseLines for values of any size, parsed with ParseNumber.
+// The value is up to the \n, a \r before it is ignored, an invalid one is an error.
+// Lines are at most maxLineSize bytes, \n included, a last line without \n is an error
+func ParseLinesGeneral(line []byte, stationMap MapStation, maxKeySize, maxLineSize int) error {
+	return parseLinesGeneral(line, stationMap, nil, maxKeySize, maxLineSize)
+}
+
+// parseLinesGeneral is ParseLinesGeneral with new stations in arena
+func parseLinesGeneral(line []byte, stationMap MapStation, arena *stationArena, maxKeySize, maxLineSize int) error {
+	for name_start := 0; name_start < len(line); {
+		name_end := findSeparator(line[name_start:min(name_start+maxKeySize+1, len(line))])
+		if name_end < 0 || line[name_start+name_end] == '\n' {
+			return keyError(line[name_start:], maxKeySize)
+		}
+		temp_start := name_start + name_end + 1
+		temp_end := bytes.IndexByte(line[temp_start:], '\n')
+		if temp_end < 0 {
+			return fmt.Errorf("Line %q has no \\n", linePreview(line[name_start:]))
+		}
+		if temp_start+temp_end+1-name_start > maxLineSize {
+			return fmt.Errorf("Line %q is longer than the max line size %d", linePreview(line[name_start:]), maxLineSize)
+		}
+		value := line[temp_start : temp_start+temp_end]
+		if len(value) > 0 && value[len(value)-1] == '\r' {
+			value = value[:len(value)-1]
+		}
+		temp := ParseNumber(value)
+		if math.IsNaN(temp) {
+			return fmt.Errorf("Line %q has an invalid number", linePreview(line[name_start:]))
+		}
+		addMeasurement(stationMap, arena, line[name_start:name_start+name_end], temp)
+		name_start = temp_start + temp_end + 1
+	}
+	return nil
+}
+
+// ParseNumber parses [+-]digits[.digits][(e|E)[+-]digits], like 1013.25, +4, -.5 or 1.2e-3.
+// Up to 15 significant digits with a small exponent are computed exactly without strconv,
+// others fallback to strconv.ParseFloat. An invalid value returns NaN
+func ParseNumber(s []byte) float64 {
+	i := 0
+	minus := false
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		minus = s[i] == '-'
+		i++
+	}
+	var mantissa uint64
+	digits, exp10 := 0, 0
+	start := i
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		if digits > 0 || s[i] != '0' {
+			digits++
+		}
+		mantissa = mantissa*10 + uint64(s[i]-'0')
+	}
+	intDigits := i - start
+	fracDigits := 0
+	if i < len(s) && s[i] == '.' {
+		i++
+		fracStart := i
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			if digits > 0 || s[i] != '0' {
+				digits++
+			}
+			mantissa = mantissa*10 + uint64(s[i]-'0')
+		}
+		fracDigits = i - fracStart
+		exp10 = -fracDigits
+	}
+	if intDigits+fracDigits == 0 {
+		return math.NaN()
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		expMinus := false
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			expMinus = s[i] == '-'
+			i++
+		}
+		expStart := i
+		exp := 0
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9' && exp < 10000; i++ {
+			exp = exp*10 + int(s[i]-'0')
+		}
+		if i == expStart {
+			return math.NaN()
+		}
+		if expMinus {
+			exp = -exp
+		}
+		exp10 += exp
+	}
+	if i != len(s) {
+		return math.NaN()
+	}
+	if digits > 15 || exp10 < -22 || exp10 > 22 {
+		f, err := strconv.ParseFloat(string(s), 64)
+		if err != nil && !math.IsInf(f, 0) {
+			return math.NaN()
+		}
+		return f
+	}
+	f := float64(mantissa)
+	if exp10 < 0 {
+		f /= float64pow10[-exp10]
+	} else if exp10 > 0 {
+		f *= float64pow10[exp10]
+	}
+	if minus {
+		f = -f
+	}
+	return f
+}
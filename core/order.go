@@ -0,0 +1,108 @@
+package brc
+
+import (
+	"bytes"
+	"cmp"
+)
+
+type BrcOrderType string
+
+const (
+	BrcOrderBytes   BrcOrderType = "bytes"   // bytes.Compare on names, the default
+	BrcOrderNatural BrcOrderType = "natural" // digits compared as numbers: id2 < id10
+	BrcOrderFirst   BrcOrderType = "first"   // order of first appearance in the file
+	BrcOrderMin     BrcOrderType = "min"     // descending aggregates, ties in bytes order
+	BrcOrderMean    BrcOrderType = "mean"
+	BrcOrderMax     BrcOrderType = "max"
+	BrcOrderCount   BrcOrderType = "count"
+)
+
+var BrcOrderList = []BrcOrderType{BrcOrderBytes, BrcOrderNatural, BrcOrderFirst, BrcOrderMin, BrcOrderMean, BrcOrderMax, BrcOrderCount}
+
+// firstThreadShift encodes the thread index in StationData.First, above the insertion index of its map
+const firstThreadShift = 40
+
+// stationCompareFunc returns the sort function of an order, bytes order if unknown or empty.
+// With exactTenths, means are computed from the snapped sum, like writeData
+func stationCompareFunc(order BrcOrderType, exactTenths bool) func(a, b *StationData) int {
+	byName := func(a, b *StationData) int {
+		return bytes.Compare(a.Name, b.Name)
+	}
+	descending := func(value func(s *StationData) float64) func(a, b *StationData) int {
+		return func(a, b *StationData) int {
+			if c := cmp.Compare(value(b), value(a)); c != 0 {
+				return c
+			}
+			return byName(a, b)
+		}
+	}
+	switch order {
+	case BrcOrderNatural:
+		return func(a, b *StationData) int {
+			return naturalCompare(a.Name, b.Name)
+		}
+	case BrcOrderFirst:
+		return func(a, b *StationData) int {
+			return cmp.Compare(a.First, b.First)
+		}
+	case BrcOrderMin:
+		return descending(func(s *StationData) float64 { return s.Min })
+	case BrcOrderMean:
+		return descending(func(s *StationData) float64 {
+			if exactTenths {
+				return snapTenths(s.Sum) / float64(s.Size)
+			}
+			return s.Sum / float64(s.Size)
+		})
+	case BrcOrderMax:
+		return descending(func(s *StationData) float64 { return s.Max })
+	case BrcOrderCount:
+		return descending(func(s *StationData) float64 { return float64(s.Size) })
+	}
+	return byName
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// naturalCompare compares a and b like bytes.Compare, except ascii digit runs compared by value.
+// Equal values with different leading zeros fall back to bytes order
+func naturalCompare(a, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return cmp.Compare(a[i], b[j])
+			}
+			i++
+			j++
+			continue
+		}
+		// skip leading zeros, then the longest run is the biggest number
+		startA, startB := i, j
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		numA, numB := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		if c := cmp.Compare(i-numA, j-numB); c != 0 {
+			return c
+		}
+		if c := bytes.Compare(a[numA:i], b[numB:j]); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(i-startA, j-startB); c != 0 {
+			return -c // more leading zeros first: 01 < 1
+		}
+	}
+	return cmp.Compare(len(a)-i, len(b)-j)
+}
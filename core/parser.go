@@ -2,6 +2,7 @@ package brc
 
 import (
 	"bytes"
+	"fmt"
 	"slices"
 )
 
@@ -14,48 +15,115 @@ type StationData struct {
 	Sum  float64
 	Size int
 	// mean = Sum/size
+	First int64 // order of first appearance: thread index << firstThreadShift | insertion index in its map
 }
 
 var patternNl = compilePattern('\n')
 var patternSemi = compilePattern(';')
 
-func ParseLines(line []byte, stationMap MapStation) {
+// ParseLines parses complete lines and aggregates them into stationMap.
+// With CRLF lines, the value ends with \r, ignored by ParseF64.
+// A line without ; in its first maxKeySize+1 bytes is an error
+func ParseLines(line []byte, stationMap MapStation, maxKeySize int) error {
+	return parseLinesFast(line, stationMap, nil, maxKeySize)
+}
+
+// parseLinesFast is ParseLines with new stations in arena.
+// Uses the SIMD separator scanner when the cpu supports it, the SWAR one otherwise
+func parseLinesFast(line []byte, stationMap MapStation, arena *stationArena, maxKeySize int) error {
+	if separatorMasks != nil {
+		return parseLinesMasked(line, stationMap, arena, maxKeySize)
+	}
+	return parseLinesSWAR(line, stationMap, arena, maxKeySize)
+}
+
+// parseLinesSWAR is the portable path, searching ; and \n 8 bytes at a time
+func parseLinesSWAR(line []byte, stationMap MapStation, arena *stationArena, maxKeySize int) error {
 	for name_start := 0; name_start < len(line); {
 		// slices.Index takes most of the time, even with a simple for loop
-		name_end := findIndexOf(line[name_start:min(name_start+104, len(line))], patternSemi) // label = 100 bytes + ;, round to power of 2
+		// label + ;, a \n first is a line without ;
+		name_end := findSeparator(line[name_start:min(name_start+maxKeySize+1, len(line))])
+		if name_end < 0 || line[name_start+name_end] == '\n' {
+			return keyError(line[name_start:], maxKeySize)
+		}
 		temp_start := name_end + 1
-		temp_end := findIndexOf(line[name_start+temp_start:min(name_start+temp_start+8, len(line))], patternNl) // temp = 5 bytes + \n, round to power of 2
+		temp_end := findIndexOf(line[name_start+temp_start:min(name_start+temp_start+8, len(line))], patternNl) // temp = 5 bytes + \r\n, round to power of 2
+		if temp_end < 0 {
+			return valueSizeError(line[name_start:])
+		}
 		nameSlice := line[name_start : name_start+name_end]
 		temp := ParseF64(line[name_start+temp_start : name_start+temp_start+temp_end])
+		addMeasurement(stationMap, arena, nameSlice, temp)
+		name_start += temp_start + temp_end + 1
+	}
+	return nil
+}
 
-		// create/get structure
-		nameHash := getHashFromBytes(nameSlice)
-		v, ok := stationMap[nameHash]
-		if !ok { // new
-			r := StationData{
-				Sum:  temp,
-				Size: 1,
-				Min:  temp,
-				Max:  temp,
-				Name: make([]byte, len(nameSlice)),
-			}
-			copy(r.Name, nameSlice)
-			stationMap[nameHash] = &r
-		} else { // update
-			v.Sum += temp
-			v.Size += 1
-			if temp < v.Min {
-				v.Min = temp
-			}
-			if temp > v.Max {
-				v.Max = temp
-			}
+// linePreview is the start of the first line of s, for error messages
+func linePreview(s []byte) []byte {
+	if end := bytes.IndexByte(s, '\n'); end >= 0 {
+		s = s[:end]
+	}
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
+
+// valueSizeError is the error of a line with a value over MAX_VALUE_SIZE_FAST bytes, \n excluded
+func valueSizeError(line []byte) error {
+	return fmt.Errorf("Line %q has a value too long for the fast number format", linePreview(line))
+}
+
+// keyError is the error of a line with no ; in its first maxKeySize+1 bytes
+func keyError(line []byte, maxKeySize int) error {
+	return fmt.Errorf("Line %q has no ';' or a key longer than the max key size %d", linePreview(line), maxKeySize)
+}
+
+// addMeasurement create/get the station structure, allocated in arena, and update it
+func addMeasurement(stationMap MapStation, arena *stationArena, nameSlice []byte, temp float64) {
+	nameHash := getHashFromBytes(nameSlice)
+	v, ok := stationMap[nameHash]
+	if !ok { // new
+		r := arena.record()
+		*r = StationData{
+			Sum:  temp,
+			Size: 1,
+			Min:  temp,
+			Max:  temp,
+			Name: arena.name(nameSlice),
+			// within a thread lines are parsed in file order, the thread is added by mergeMaps
+			First: int64(len(stationMap)),
+		}
+		stationMap[nameHash] = r
+	} else { // update
+		v.Sum += temp
+		v.Size += 1
+		if temp < v.Min {
+			v.Min = temp
+		}
+		if temp > v.Max {
+			v.Max = temp
 		}
-		name_start += temp_start + temp_end + 1
 	}
 }
 
-func mergeMaps(allStationMaps []MapStation, stationLst *[]*StationData) MapStation {
+// mergeMaps merges all thread maps into the sorted stationLst, by partitions when there are many stations.
+// The merge of each partition is traced in the spans of workers
+func mergeMaps(allStationMaps []MapStation, stationLst *[]*StationData, compare func(a, b *StationData) int, workers []WorkerStats) {
+	nStations := 0
+	for _, stationMap := range allStationMaps {
+		nStations += len(stationMap)
+	}
+	if len(allStationMaps) > 1 && nStations >= parallelMergeMin {
+		mergeMapsPartitioned(allStationMaps, stationLst, compare, workers)
+		return
+	}
+	mergeMapsSequential(allStationMaps, stationLst, compare)
+}
+
+// mergeMapsSequential merges all maps into the first one and sorts on one core
+func mergeMapsSequential(allStationMaps []MapStation, stationLst *[]*StationData, compare func(a, b *StationData) int) {
 	baseMap := allStationMaps[0]
 	// add unseen station pointer to an array to sort them later
 	for _, v := range baseMap {
@@ -64,24 +132,27 @@ func mergeMaps(allStationMaps []MapStation, stationLst *[]*StationData) MapStati
 	for i := 1; i < len(allStationMaps); i++ {
 		newMap := allStationMaps[i]
 		for newKey, newValue := range newMap {
+			newValue.First |= int64(i) << firstThreadShift
 			v, ok := baseMap[newKey]
 			if !ok { // new
 				*stationLst = append(*stationLst, newValue)
 				baseMap[newKey] = newValue
-			} else { // update
-				v.Sum += newValue.Sum
-				v.Size += newValue.Size
-				if newValue.Min < v.Min {
-					v.Min = newValue.Min
-				}
-				if newValue.Max > v.Max {
-					v.Max = newValue.Max
-				}
+			} else { // update, maps are in file order so First is already the lowest
+				mergeStation(v, newValue)
 			}
 		}
 	}
-	slices.SortFunc(*stationLst, func(a *StationData, b *StationData) int {
-		return bytes.Compare((*a).Name, (*b).Name)
-	})
-	return baseMap
+	slices.SortFunc(*stationLst, compare)
+}
+
+// mergeStation adds the measurements of other to station
+func mergeStation(station, other *StationData) {
+	station.Sum += other.Sum
+	station.Size += other.Size
+	if other.Min < station.Min {
+		station.Min = other.Min
+	}
+	if other.Max > station.Max {
+		station.Max = other.Max
+	}
 }
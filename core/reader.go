@@ -19,6 +19,17 @@ type FileReader interface {
 	GetChunk(offset, size int64) ([]byte, int64)
 }
 
+// NewFileReader returns a closed reader of the given type
+func NewFileReader(readerType BrcReaderType) (FileReader, error) {
+	switch readerType {
+	case BrcReaderMmap:
+		return NewFileMmapReader(), nil
+	case BrcReaderDisk:
+		return NewFileDiskReader(), nil
+	}
+	return nil, fmt.Errorf("Unknown reader: %s", readerType)
+}
+
 type _FileCommonReader struct {
 	filename string
 	size     int64
@@ -71,6 +82,16 @@ func (fileReader *FileDiskReader) GetFilename() string {
 	return fileReader.filename
 }
 
+// refreshSize updates the size of a file being appended to
+func (fileReader *FileDiskReader) refreshSize() (int64, error) {
+	info, err := fileReader.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileReader.size = info.Size()
+	return fileReader.size, nil
+}
+
 func (fileReader *FileDiskReader) ReadChunk(buffer []byte, offset int64) (int64, error) {
 	if offset >= int64(fileReader.size) || len(buffer) == 0 {
 		return 0, nil
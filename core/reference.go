@@ -0,0 +1,52 @@
+package brc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// ReferenceSolve is the simplest possible implementation, one thread and the standard library only.
+// It is slow but obviously correct, to check Solve against it. Only opts.Number and opts.Precision are used
+func ReferenceSolve(input io.Reader, file_out string, opts BrcOptions) error {
+	stations := make(map[string]*StationData)
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_LINE_SIZE*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte{'\r'})
+		if lineNumber == 1 {
+			line = bytes.TrimPrefix(line, utf8BOM)
+		}
+		name, value, found := bytes.Cut(line, []byte{';'})
+		if !found {
+			return fmt.Errorf("line %d: missing ';'", lineNumber)
+		}
+		temp, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		station, ok := stations[string(name)]
+		if !ok {
+			stations[string(name)] = &StationData{Name: bytes.Clone(name), Min: temp, Max: temp, Sum: temp, Size: 1}
+			continue
+		}
+		station.Min = min(station.Min, temp)
+		station.Max = max(station.Max, temp)
+		station.Sum += temp
+		station.Size++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	stationLst := make([]*StationData, 0, len(stations))
+	for _, station := range stations {
+		stationLst = append(stationLst, station)
+	}
+	slices.SortFunc(stationLst, func(a *StationData, b *StationData) int {
+		return bytes.Compare(a.Name, b.Name)
+	})
+	return writeData(file_out, stationLst, opts.outputPrecision(), opts.Number != BrcNumberGeneral)
+}
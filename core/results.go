@@ -0,0 +1,246 @@
+package brc
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ResultStation is one station of a result file
+type ResultStation struct {
+	Name   string
+	Min    float64
+	Mean   float64
+	Max    float64
+	Count  int64   // -1 if the format does not have it, estimated for approximate results
+	MeanCI float64 // half width of the confidence interval of Mean for approximate results, 0 otherwise
+}
+
+// resultValuesRe matches the values following the = of a station in the brace format
+// with ` ±ci ~count` after the max in approximate results
+var resultValuesRe = regexp.MustCompile(`^=([-+0-9.eE]+)/([-+0-9.eE]+)/([-+0-9.eE]+)(?: ±([-+0-9.eE]+|NaN) ~([0-9]+))?(, |}\n?$)`)
+
+// ReadResults reads a result file in the brace format ({name=min/mean/max, ...}), approximate or not,
+// or the per-station gauges of the OpenMetrics format
+func ReadResults(filename string) ([]ResultStation, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(ApproximateHeader)) {
+		if _, data, _ = bytes.Cut(data, []byte{'\n'}); !bytes.HasPrefix(data, []byte("{")) {
+			return nil, fmt.Errorf("%s: invalid approximate result", filename)
+		}
+	}
+	if bytes.HasPrefix(data, []byte("{")) {
+		return parseBraceResults(data)
+	}
+	if bytes.HasPrefix(data, []byte("#")) {
+		return parseMetricsResults(bytes.NewReader(data))
+	}
+	return nil, fmt.Errorf("%s: unknown result format", filename)
+}
+
+// parseBraceResults parses {name=min/mean/max, ...}. Names can contain "=" or ", ",
+// so a name ends at the first "=" followed by 3 numbers and ", " or "}"
+func parseBraceResults(data []byte) ([]ResultStation, error) {
+	var err error
+	var stations []ResultStation
+	content := string(data[1:])
+	if strings.TrimSuffix(content, "\n") == "}" {
+		return stations, nil
+	}
+	for start, pos := 0, 0; ; pos++ {
+		eq := strings.IndexByte(content[pos:], '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid result at byte %d: %.40q", start+1, content[start:])
+		}
+		pos += eq
+		match := resultValuesRe.FindStringSubmatch(content[pos:])
+		if match == nil {
+			continue
+		}
+		station := ResultStation{Name: content[start:pos], Count: -1}
+		for i, value := range []*float64{&station.Min, &station.Mean, &station.Max} {
+			if *value, err = strconv.ParseFloat(match[i+1], 64); err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %v", station.Name, err)
+			}
+		}
+		if len(match[4]) > 0 {
+			station.MeanCI, _ = strconv.ParseFloat(match[4], 64)
+			station.Count, _ = strconv.ParseInt(match[5], 10, 64)
+		}
+		stations = append(stations, station)
+		if match[6] != ", " {
+			return stations, nil
+		}
+		pos += len(match[0]) - 1
+		start = pos + 1
+	}
+}
+
+// parseMetricsResults reads the brc_station_* gauges written by RunMetrics
+func parseMetricsResults(reader io.Reader) ([]ResultStation, error) {
+	byName := make(map[string]*ResultStation)
+	var stations []*ResultStation
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	unescape := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+	for scanner.Scan() {
+		line := scanner.Text()
+		metric, rest, found := strings.Cut(line, `{station="`)
+		if !found || !strings.HasPrefix(metric, "brc_station_") {
+			continue
+		}
+		end := strings.LastIndex(rest, `"} `)
+		if end < 0 {
+			return nil, fmt.Errorf("invalid metric: %q", line)
+		}
+		name := unescape.Replace(rest[:end])
+		value, err := strconv.ParseFloat(rest[end+3:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric: %q", line)
+		}
+		station, ok := byName[name]
+		if !ok {
+			station = &ResultStation{Name: name, Count: -1}
+			byName[name] = station
+			stations = append(stations, station)
+		}
+		switch metric {
+		case "brc_station_min":
+			station.Min = value
+		case "brc_station_mean":
+			station.Mean = value
+		case "brc_station_max":
+			station.Max = value
+		case "brc_station_measurements":
+			station.Count = int64(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	result := make([]ResultStation, len(stations))
+	for i, station := range stations {
+		result[i] = *station
+	}
+	return result, nil
+}
+
+type DiffKind string
+
+const (
+	DiffMissing DiffKind = "missing" // in expected only
+	DiffExtra   DiffKind = "extra"   // in computed only
+	DiffChanged DiffKind = "changed" // a field delta is above the tolerance
+)
+
+type ResultDiff struct {
+	Kind     DiffKind
+	Name     string
+	Field    string // min, mean, max or count for DiffChanged
+	Expected float64
+	Computed float64
+}
+
+func (diff ResultDiff) String() string {
+	if diff.Kind != DiffChanged {
+		return fmt.Sprintf("%s %q", diff.Kind, diff.Name)
+	}
+	return fmt.Sprintf("%s %q %s: %g => %g (delta %+.6g)", diff.Kind, diff.Name, diff.Field,
+		diff.Expected, diff.Computed, diff.Computed-diff.Expected)
+}
+
+// DiffResults lists the stations missing from or extra in computed, and the fields with a delta
+// above tolerance. Counts are only compared when both results have them
+func DiffResults(expected, computed []ResultStation, tolerance float64) []ResultDiff {
+	var diffs []ResultDiff
+	computedByName := make(map[string]ResultStation, len(computed))
+	for _, station := range computed {
+		computedByName[station.Name] = station
+	}
+	expectedNames := make(map[string]bool, len(expected))
+	for _, exp := range expected {
+		expectedNames[exp.Name] = true
+		comp, ok := computedByName[exp.Name]
+		if !ok {
+			diffs = append(diffs, ResultDiff{Kind: DiffMissing, Name: exp.Name})
+			continue
+		}
+		fields := []struct {
+			name               string
+			expected, computed float64
+		}{{"min", exp.Min, comp.Min}, {"mean", exp.Mean, comp.Mean}, {"max", exp.Max, comp.Max}}
+		if exp.Count >= 0 && comp.Count >= 0 {
+			fields = append(fields, struct {
+				name               string
+				expected, computed float64
+			}{"count", float64(exp.Count), float64(comp.Count)})
+		}
+		for _, field := range fields {
+			// 1e-9 absorbs the float error of values printed with a few decimals
+			if math.Abs(field.computed-field.expected) > tolerance+1e-9 {
+				diffs = append(diffs, ResultDiff{DiffChanged, exp.Name, field.name, field.expected, field.computed})
+			}
+		}
+	}
+	for _, comp := range computed {
+		if !expectedNames[comp.Name] {
+			diffs = append(diffs, ResultDiff{Kind: DiffExtra, Name: comp.Name})
+		}
+	}
+	slices.SortStableFunc(diffs, func(a, b ResultDiff) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return diffs
+}
+
+// DiffResultFiles reads and compares two result files, see DiffResults
+func DiffResultFiles(expectedFile, computedFile string, tolerance float64) ([]ResultDiff, error) {
+	expected, err := ReadResults(expectedFile)
+	if err != nil {
+		return nil, err
+	}
+	computed, err := ReadResults(computedFile)
+	if err != nil {
+		return nil, err
+	}
+	return DiffResults(expected, computed, tolerance), nil
+}
+
+// MergeResultFiles merges result files with counts, OpenMetrics or approximate, e.g. the results of the parts
+// of a file, in file_out. Means are weighted by the counts, they are the rounded means of the files
+func MergeResultFiles(files []string, file_out string, opts BrcOptions) error {
+	merged := make(map[string]*StationData)
+	var stationLst []*StationData
+	for _, file := range files {
+		stations, err := ReadResults(file)
+		if err != nil {
+			return err
+		}
+		for _, result := range stations {
+			if result.Count < 0 {
+				return fmt.Errorf("%s: %q has no count, only results with counts can be merged", file, result.Name)
+			}
+			station := &StationData{Name: []byte(result.Name), Min: result.Min, Max: result.Max,
+				Sum: result.Mean * float64(result.Count), Size: int(result.Count), First: int64(len(stationLst))}
+			if v, ok := merged[result.Name]; ok {
+				mergeStation(v, station)
+				continue
+			}
+			merged[result.Name] = station
+			stationLst = append(stationLst, station)
+		}
+	}
+	slices.SortFunc(stationLst, stationCompareFunc(opts.Order, false))
+	return writeData(file_out, stationLst, opts.outputPrecision(), false)
+}
@@ -0,0 +1,190 @@
+package brc
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// sampleZ is the z-score of the 95% confidence intervals
+const sampleZ = 1.96
+
+// ApproximateHeader starts the output of a sampled run
+const ApproximateHeader = "# approximate"
+
+// sampleCluster are the sums over the sampled blocks of the squares and products of y, the sum
+// of the values of a station in a block, and m, its number of values. They give the variance of the mean
+type sampleCluster struct {
+	blocks int // blocks with the station
+	yy     float64
+	mm     float64
+	ym     float64
+}
+
+// sampledBlocks returns the sorted indexes of the blocks to parse when sampling, blocks are chunks of the file.
+// Returns nil when opts.Sample doesn't skip any block
+func sampledBlocks(size, blockSize int64, opts BrcOptions) []int64 {
+	if opts.Sample <= 0 || opts.Sample >= 1 || blockSize < 1 || opts.NThreads < 1 {
+		return nil // parseFile reports invalid options
+	}
+	nBlocks := (size + blockSize - 1) / blockSize
+	// at least 2 blocks for a variance
+	n := max(2, int64(math.Ceil(opts.Sample*float64(nBlocks))))
+	if n >= nBlocks {
+		return nil
+	}
+	rng := rand.New(rand.NewPCG(opts.SampleSeed, 43))
+	blocks := make([]int64, 0, n)
+	for _, block := range rng.Perm(int(nBlocks))[:n] {
+		blocks = append(blocks, int64(block))
+	}
+	slices.Sort(blocks)
+	return blocks
+}
+
+// solveSampled parses the blocks with the asyncLazyRead boundaries, each one as a thread range,
+// and writes the means with their confidence interval and the estimated counts
+func solveSampled(fileReader FileReader, file_out string, opts BrcOptions, blockSize int64, blocks []int64,
+	stats SolveStats, stationLst *[]*StationData, origin time.Time) (SolveStats, error) {
+	format, err := newLineFormat(opts)
+	if err != nil {
+		return stats, err
+	}
+	timeBefore := time.Now()
+	size := fileReader.GetSize()
+	readSize := min(blockSize, int64(16*os.Getpagesize()))
+	// First is the block and the insertion index in it, lower than the block size
+	firstShift := bits.Len64(uint64(blockSize))
+	nThreads := min(opts.NThreads, len(blocks))
+	maps := make([]MapStation, nThreads)
+	clusters := make([]map[uint64]*sampleCluster, nThreads)
+	stats.Workers = make([]WorkerStats, nThreads)
+	var wg sync.WaitGroup
+	for t := range nThreads {
+		worker := &stats.Workers[t]
+		worker.Id = t
+		worker.Start = blocks[t] * blockSize
+		worker.tracing = len(opts.TraceFile) > 0
+		worker.arena = &stationArena{}
+		if opts.Metrics != nil {
+			worker.progress = &opts.Metrics.progress
+		}
+		maps[t] = make(MapStation, 1024)
+		clusters[t] = make(map[uint64]*sampleCluster, 1024)
+		wg.Go(func() {
+			for i := t; i < len(blocks) && worker.err == nil; i += nThreads {
+				block := blocks[i]
+				blockMap := make(MapStation)
+				asyncLazyRead(fileReader, readSize, block, blockSize, blockMap, format, nil, worker)
+				worker.End = min((block+1)*blockSize, size)
+				for key, station := range blockMap {
+					station.First |= block << firstShift
+					cluster, ok := clusters[t][key]
+					if !ok {
+						cluster = &sampleCluster{}
+						clusters[t][key] = cluster
+					}
+					y, m := station.Sum, float64(station.Size)
+					cluster.blocks++
+					cluster.yy += y * y
+					cluster.mm += m * m
+					cluster.ym += y * m
+					if v, ok := maps[t][key]; ok {
+						mergeStation(v, station)
+						v.First = min(v.First, station.First)
+					} else {
+						maps[t][key] = station
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+	for _, worker := range stats.Workers {
+		if worker.err != nil {
+			return stats, worker.err
+		}
+	}
+	for i, stationMap := range maps {
+		stats.Workers[i].Stations = len(stationMap)
+		for _, station := range stationMap {
+			stats.Workers[i].Lines += int64(station.Size)
+		}
+	}
+	stats.ParseTime = time.Since(timeBefore)
+	timeBefore = time.Now()
+	for t := 1; t < nThreads; t++ {
+		for key, station := range maps[t] {
+			cluster := clusters[t][key]
+			if v, ok := maps[0][key]; ok {
+				mergeStation(v, station)
+				v.First = min(v.First, station.First)
+				c := clusters[0][key]
+				c.blocks += cluster.blocks
+				c.yy += cluster.yy
+				c.mm += cluster.mm
+				c.ym += cluster.ym
+			} else {
+				maps[0][key] = station
+				clusters[0][key] = cluster
+			}
+		}
+	}
+	for _, station := range maps[0] {
+		*stationLst = append(*stationLst, station)
+	}
+	slices.SortFunc(*stationLst, stationCompareFunc(opts.Order, opts.Number != BrcNumberGeneral))
+	stats.Stations = len(*stationLst)
+	for _, station := range *stationLst {
+		stats.Lines += int64(station.Size)
+	}
+	stats.MergeTime = time.Since(timeBefore)
+	timeBefore = time.Now()
+	var sampledBytes int64
+	for _, block := range blocks {
+		sampledBytes += min(blockSize, size-block*blockSize)
+	}
+	nBlocks := (size + blockSize - 1) / blockSize
+	n := float64(len(blocks))
+	scale := float64(size) / float64(sampledBytes)
+	out, err := createOutput(file_out)
+	if err != nil {
+		return stats, err
+	}
+	defer out.abort()
+	fmt.Fprintf(out, "%s: %.2f%% of the file (%d of %d blocks, seed %d), min/max of the sample, mean ±95%% confidence interval, ~estimated count\n",
+		ApproximateHeader, 100/scale, len(blocks), nBlocks, opts.SampleSeed)
+	writer := newStationWriter(out, opts.outputPrecision(), opts.Number != BrcNumberGeneral)
+	writer.annotate = func(station *StationData) string {
+		// ratio estimator of a cluster sample: var(mean) = (1-n/N) Σ(y - mean*m)² / ((n-1) n mbar²)
+		cluster := clusters[0][getHashFromBytes(station.Name)]
+		count := int64(math.Round(float64(station.Size) * scale))
+		if cluster.blocks < 2 {
+			// no variance between blocks
+			return fmt.Sprintf(" ±NaN ~%d", count)
+		}
+		mean := station.Sum / float64(station.Size)
+		mbar := float64(station.Size) / n
+		sumSquares := max(0, cluster.yy-2*mean*cluster.ym+mean*mean*cluster.mm)
+		variance := (1 - n/float64(nBlocks)) * sumSquares / ((n - 1) * n * mbar * mbar)
+		return fmt.Sprintf(" ±%.*f ~%d", writer.precision, sampleZ*math.Sqrt(variance), count)
+	}
+	for _, station := range *stationLst {
+		if err := writer.write(station); err != nil {
+			return stats, err
+		}
+	}
+	if err := writer.close(); err != nil {
+		return stats, err
+	}
+	if err := out.commit(); err != nil {
+		return stats, err
+	}
+	stats.WriteTime = time.Since(timeBefore)
+	return stats, reportWorkers(opts, stats, origin)
+}
@@ -0,0 +1,74 @@
+package brc
+
+import "math/bits"
+
+const maskBlockSize = 4096                // bytes scanned per separatorMasks call
+const maskBlockWords = maskBlockSize / 64 // one bit per byte, 64 bytes per word
+
+// separatorMasks is set at startup when the cpu has a SIMD implementation (see scan_amd64.go).
+// It fills semi and nl with one bit per byte of src (bit i of word w <=> src[w*64+i])
+// and must handle len(src) not multiple of 64, semi and nl must be (len(src)+63)/64 long
+var separatorMasks func(src []byte, semi, nl []uint64)
+
+// separatorMasksGeneric is the pure Go version of separatorMasks, used for the
+// tail of the SIMD implementations
+func separatorMasksGeneric(src []byte, semi, nl []uint64) {
+	for w := 0; w*64 < len(src); w++ {
+		var s, n uint64
+		block := src[w*64 : min(w*64+64, len(src))]
+		for i, c := range block {
+			switch c {
+			case ';':
+				s |= 1 << i
+			case '\n':
+				n |= 1 << i
+			}
+		}
+		semi[w] = s
+		nl[w] = n
+	}
+}
+
+// parseLinesMasked walks the ; and \n bitmasks of line, maskBlockSize bytes at a time, and returns the same
+// stations and errors as parseLinesSWAR: the name ends at the first ;, values are at most MAX_VALUE_SIZE_FAST bytes.
+// Lines can cross blocks, nameStart and nameEnd are kept between them
+func parseLinesMasked(line []byte, stationMap MapStation, arena *stationArena, maxKeySize int) error {
+	var semiMask, nlMask [maskBlockWords]uint64
+	nameStart, nameEnd := 0, -1 // nameEnd < nameStart until the first ; of the line
+	for blockStart := 0; blockStart < len(line); blockStart += maskBlockSize {
+		block := line[blockStart:min(blockStart+maskBlockSize, len(line))]
+		nWords := (len(block) + 63) / 64
+		separatorMasks(block, semiMask[:nWords], nlMask[:nWords])
+		for w := range nWords {
+			semis := semiMask[w]
+			all := semis | nlMask[w]
+			for all != 0 {
+				bit := bits.TrailingZeros64(all)
+				all &= all - 1
+				pos := blockStart + w*64 + bit
+				if semis&(1<<bit) != 0 {
+					if nameEnd < nameStart {
+						nameEnd = pos
+					}
+					continue
+				}
+				if nameEnd < nameStart || nameEnd-nameStart > maxKeySize {
+					return keyError(line[nameStart:], maxKeySize)
+				}
+				if pos-nameEnd-1 > MAX_VALUE_SIZE_FAST {
+					return valueSizeError(line[nameStart:])
+				}
+				addMeasurement(stationMap, arena, line[nameStart:nameEnd], ParseF64(line[nameEnd+1:pos]))
+				nameStart = pos + 1
+			}
+		}
+	}
+	// a last line without \n
+	if nameStart < len(line) {
+		if nameEnd < nameStart || nameEnd-nameStart > maxKeySize {
+			return keyError(line[nameStart:], maxKeySize)
+		}
+		return valueSizeError(line[nameStart:])
+	}
+	return nil
+}
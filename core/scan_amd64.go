@@ -0,0 +1,55 @@
+package brc
+
+// Implemented in scan_amd64.s
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+func xgetbv() (eax, edx uint32)
+
+// separatorMasksAVX2 and separatorMasksSSE2 only handle len(src)/64*64 bytes
+func separatorMasksAVX2(src []byte, semi, nl []uint64)
+func separatorMasksSSE2(src []byte, semi, nl []uint64)
+
+var hasSSE2, hasAVX2 = detectCPUFeatures()
+
+func init() {
+	switch {
+	case hasAVX2:
+		separatorMasks = withGenericTail(separatorMasksAVX2)
+	case hasSSE2:
+		separatorMasks = withGenericTail(separatorMasksSSE2)
+	}
+}
+
+// detectCPUFeatures checks cpu and OS support, AVX2 needs the OS to save YMM registers
+// See https://www.intel.com/content/www/us/en/developer/articles/technical/intel-sdm.html (Vol. 2A, CPUID)
+func detectCPUFeatures() (sse2, avx2 bool) {
+	maxID, _, _, _ := cpuid(0, 0)
+	if maxID < 1 {
+		return false, false
+	}
+	_, _, ecx1, edx1 := cpuid(1, 0)
+	sse2 = edx1&(1<<26) != 0
+	osxsave := ecx1&(1<<27) != 0
+	avx := ecx1&(1<<28) != 0
+	if maxID < 7 || !osxsave || !avx {
+		return sse2, false
+	}
+	if xcr0, _ := xgetbv(); xcr0&0b110 != 0b110 { // XMM and YMM state
+		return sse2, false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	avx2 = ebx7&(1<<5) != 0
+	return sse2, avx2
+}
+
+// withGenericTail completes a SIMD scanner with the pure Go one for the last partial word
+func withGenericTail(simd func(src []byte, semi, nl []uint64)) func(src []byte, semi, nl []uint64) {
+	return func(src []byte, semi, nl []uint64) {
+		full := len(src) / 64
+		if full > 0 {
+			simd(src[:full*64], semi[:full], nl[:full])
+		}
+		if full*64 < len(src) {
+			separatorMasksGeneric(src[full*64:], semi[full:], nl[full:])
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package brc
+
+import "testing"
+
+func TestSeparatorMasksSSE2(t *testing.T) {
+	if !hasSSE2 {
+		t.Skip("no SSE2")
+	}
+	checkSeparatorMasks(t, withGenericTail(separatorMasksSSE2))
+}
+
+func TestSeparatorMasksAVX2(t *testing.T) {
+	if !hasAVX2 {
+		t.Skip("no AVX2")
+	}
+	checkSeparatorMasks(t, withGenericTail(separatorMasksAVX2))
+}
@@ -0,0 +1,5 @@
+//go:build !amd64
+
+package brc
+
+// No SIMD implementation, separatorMasks stays nil and ParseLines uses the SWAR path
@@ -1,22 +1,37 @@
 package brc
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
-const MAX_LINE_SIZE = 128 // label=100, ;=1, temp=5,\n=1 => 107, round to 128
-const MIN_LINE_SIZE = 6   // label=1, ;=1, temp=3,\n=1 => 6
+const MAX_KEY_SIZE = 100            // default BrcOptions.MaxKeySize
+const MAX_LINE_SIZE = 128           // default BrcOptions.MaxLineSize: label=100, ;=1, temp=5,\n=1 => 107, round to 128
+const MAX_LINE_SIZE_LIMIT = 1 << 20 // upper bound of BrcOptions.MaxLineSize
+const MIN_LINE_SIZE = 6             // label=1, ;=1, temp=3,\n=1 => 6
+const MIN_LINE_SIZE_GENERAL = 4     // label=1, ;=1, temp=1,\n=1 => 4, the default MAX_LINE_SIZE allows 25 bytes values
+const MAX_VALUE_SIZE_FAST = 7       // -99.9 + \r\n
 
 // calcChunkAndThreadSize adapt parameters for multithreaded read
-// Does not modify nThread or initial thChunkSize, only the chunkSize parameter is adapted
-func calcChunkAndThreadSize(size int64, chunkSize, nThreads int) (int64, int, int) {
+// Does not modify nThread or initial thChunkSize, only the chunkSize parameter is adapted,
+// unless maxMemory > 0: read buffers (2 chunks per thread) are then limited to half of it
+// by lowering chunkSize first, then nThreads
+func calcChunkAndThreadSize(size int64, chunkSize, nThreads int, maxMemory, maxLineSize int64) (int64, int, int) {
+	pageSize := os.Getpagesize()
+	if maxMemory > 0 {
+		bufferBudget := maxMemory / 2
+		for chunkSize > 1 && int64(nThreads)*lazyBufferSize(int64(chunkSize*pageSize), maxLineSize) > bufferBudget {
+			chunkSize /= 2
+		}
+		nThreads = int(max(1, min(int64(nThreads), bufferBudget/lazyBufferSize(int64(chunkSize*pageSize), maxLineSize))))
+	}
 	thChunkSize := size / int64(nThreads)
 	if size%int64(nThreads) != 0 {
 		thChunkSize += 1
 	}
-	pageSize := os.Getpagesize()
 	chunkSize *= pageSize // chunkSize is a factor of pagesize
 	if int64(chunkSize) > thChunkSize {
 		thChunkSize = min(int64(chunkSize), size) // grow thChunkSize
@@ -28,56 +43,307 @@ func calcChunkAndThreadSize(size int64, chunkSize, nThreads int) (int64, int, in
 	return thChunkSize, chunkSize, nThreads
 }
 
-func parseFile(fileReader FileReader, opts BrcOptions, allStationMaps *[]MapStation) error {
+// parseFile parses the file with one MapStation per thread, flushed in table or spilled if they are not nil
+func parseFile(fileReader FileReader, opts BrcOptions, estimated cardinality, table *sharedTable, spill *spillRuns,
+	allStationMaps *[]MapStation, workers *[]WorkerStats) error {
 	if opts.ReadChunkFactor < 1 {
 		return fmt.Errorf("chunk_size must be greater than 0")
 	}
 	if opts.NThreads < 1 {
 		return fmt.Errorf("n_threads must be greater than 1")
 	}
+	format, err := newLineFormat(opts)
+	if err != nil {
+		return err
+	}
 	t_chunk_size, chunkSize, nThreads := calcChunkAndThreadSize(
-		fileReader.GetSize(), opts.ReadChunkFactor, opts.NThreads)
+		fileReader.GetSize(), opts.ReadChunkFactor, opts.NThreads, opts.MaxMemory, format.maxSize)
+	budget := newMemoryBudget(opts.MaxMemory)
+	if opts.Strategy == BrcStrategyPreRead {
+		budget.grow(fileReader.GetSize())
+	} else {
+		budget.grow(int64(nThreads) * lazyBufferSize(int64(chunkSize), format.maxSize))
+	}
+	if table != nil { // thread maps are bounded, stations are counted when new in the table
+		budget.grow(int64(nThreads) * sharedFlushSize * stationMemSize)
+	}
+	if spill != nil { // thread maps are bounded, the stations are on disk
+		spill.maxStations = int(max(1, opts.SpillMemory/stationMemSize/int64(nThreads)))
+		spill.runs = make([]spillRun, nThreads)
+		budget.grow(int64(nThreads*spill.maxStations) * stationMemSize)
+	}
+	// presized with the estimated stations of a thread, up to the bound of a thread map
+	mapSize := estimated.threadStations(nThreads)
+	if table != nil {
+		mapSize = min(mapSize, sharedFlushSize)
+	}
+	if spill != nil {
+		mapSize = min(mapSize, int64(spill.maxStations))
+	}
+	if opts.MaxMemory > 0 {
+		mapSize = min(mapSize, opts.MaxMemory/2/stationMemSize/int64(nThreads))
+	}
 	*allStationMaps = make([]MapStation, nThreads)
 	for i := range *allStationMaps {
-		// arbitrary value, better too much than future allocation needed
-		(*allStationMaps)[i] = make(MapStation, 1024)
+		(*allStationMaps)[i] = make(MapStation, max(1024, mapSize))
+	}
+	if err := budget.err(); err != nil {
+		return err
 	}
+	*workers = make([]WorkerStats, nThreads)
 	var wg sync.WaitGroup
 	for i := range nThreads {
+		stats := &(*workers)[i]
+		stats.Id = i
+		stats.Start = min(int64(i)*t_chunk_size, fileReader.GetSize())
+		stats.End = min(int64(i+1)*t_chunk_size, fileReader.GetSize())
+		stats.tracing = len(opts.TraceFile) > 0
+		if opts.Metrics != nil {
+			stats.progress = &opts.Metrics.progress
+		}
+		stats.shared = table
+		stats.arena = &stationArena{}
+		stats.spill = spill
+		if table == nil && spill == nil {
+			stats.keys = &hyperLogLog{}
+		}
 		wg.Go(func() {
 			switch opts.Strategy {
 			case BrcStrategyPreRead:
-				asyncPreRead(fileReader, int64(chunkSize), int64(i), t_chunk_size, (*allStationMaps)[i])
+				asyncPreRead(fileReader, int64(chunkSize), int64(i), t_chunk_size, (*allStationMaps)[i], format, budget, stats)
 			case BrcStrategyLazyRead:
-				asyncLazyRead(fileReader, int64(chunkSize), int64(i), t_chunk_size, (*allStationMaps)[i])
+				asyncLazyRead(fileReader, int64(chunkSize), int64(i), t_chunk_size, (*allStationMaps)[i], format, budget, stats)
 			default:
 				return
 			}
+			if table != nil {
+				budget.growStations(stats.flush((*allStationMaps)[i]))
+			}
+			if spill != nil && stats.err == nil {
+				stats.err = stats.spillMap((*allStationMaps)[i])
+			}
+			if stats.keys != nil {
+				stats.keys.addMap((*allStationMaps)[i])
+			}
 		})
 	}
 	wg.Wait()
+	for _, stats := range *workers {
+		if stats.err != nil {
+			return stats.err
+		}
+	}
+	// before merge, which updates the stations of the first map, thread maps are empty if flushed
+	for i, stationMap := range *allStationMaps {
+		(*workers)[i].Stations += len(stationMap)
+		for _, station := range stationMap {
+			(*workers)[i].Lines += int64(station.Size)
+		}
+	}
+	return budget.err()
+}
+
+// lineFormat is how lines are parsed, and their size bounds (\n included) for the thread boundaries
+type lineFormat struct {
+	number     BrcNumberType
+	minSize    int64
+	maxSize    int64
+	maxKeySize int
+}
+
+// newLineFormat checks the key and line size limits of opts
+func newLineFormat(opts BrcOptions) (*lineFormat, error) {
+	maxKeySize := opts.MaxKeySize
+	if maxKeySize == 0 {
+		maxKeySize = MAX_KEY_SIZE
+	}
+	maxLineSize := opts.MaxLineSize
+	if maxLineSize == 0 {
+		maxLineSize = maxKeySize + MAX_LINE_SIZE - MAX_KEY_SIZE
+	}
+	if maxKeySize < 1 {
+		return nil, fmt.Errorf("Max key size must be greater than 0")
+	}
+	if maxLineSize > MAX_LINE_SIZE_LIMIT {
+		return nil, fmt.Errorf("Max line size %d is over the limit of %d", maxLineSize, MAX_LINE_SIZE_LIMIT)
+	}
+	// room for the longest key and a value of the fast format
+	if maxLineSize < maxKeySize+1+MAX_VALUE_SIZE_FAST {
+		return nil, fmt.Errorf("Max line size %d is too small for the max key size %d, at least %d is needed",
+			maxLineSize, maxKeySize, maxKeySize+1+MAX_VALUE_SIZE_FAST)
+	}
+	format := &lineFormat{number: opts.Number, minSize: MIN_LINE_SIZE, maxSize: int64(maxLineSize), maxKeySize: maxKeySize}
+	if opts.Number == BrcNumberGeneral {
+		format.minSize = MIN_LINE_SIZE_GENERAL
+	}
+	return format, nil
+}
+
+// parse parses complete lines into stationMap, new stations are allocated in arena
+func (format *lineFormat) parse(line []byte, stationMap MapStation, arena *stationArena) error {
+	if format.number == BrcNumberGeneral {
+		return parseLinesGeneral(line, stationMap, arena, format.maxKeySize, int(format.maxSize))
+	}
+	return parseLinesFast(line, stationMap, arena, format.maxKeySize)
+}
+
+// lineSizeError is the error of a line without \n in the maxSize bytes from offset
+func (format *lineFormat) lineSizeError(offset int64) error {
+	return fmt.Errorf("Line at byte %d is longer than the max line size %d", offset, format.maxSize)
+}
+
+// lazyBufferSize is the size of the read buffer of each asyncLazyRead thread
+func lazyBufferSize(chunk_size, maxLineSize int64) int64 {
+	return max(chunk_size*2, maxLineSize*2)
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// hasBOM returns true if the file starts with an utf8 BOM, to skip it in the first thread
+func hasBOM(fileReader FileReader) bool {
+	var buff [3]byte
+	n, _ := fileReader.ReadChunk(buff[:], 0)
+	return n == 3 && bytes.Equal(buff[:], utf8BOM)
+}
+
+// parseLastLine parses the last line of a file without a final \n, a copy is needed to add it
+func parseLastLine(line []byte, offset int64, stationMap MapStation, format *lineFormat, stats *WorkerStats) {
+	if int64(len(line)) > format.maxSize-1 {
+		stats.err = format.lineSizeError(offset)
+		return
+	}
+	if int64(len(line)) < format.minSize-1 {
+		return
+	}
+	timeBefore := time.Now()
+	stats.err = format.parse(append(line[:len(line):len(line)], '\n'), stationMap, stats.arena)
+	stats.addParse(timeBefore)
+}
+
+// lineRange is the lines starting in (start, end] of a thread, and from the file start for the first one:
+// the line starting at start is in the previous thread, like in asyncLazyRead
+type lineRange struct {
+	start, end int64
+}
+
+// lineRanges splits the file in the thread ranges of parseFile, returns them with the read chunk size
+func lineRanges(size int64, opts BrcOptions, format *lineFormat) ([]lineRange, int64) {
+	t_chunk_size, chunk_size, nThreads := calcChunkAndThreadSize(size, max(opts.ReadChunkFactor, 1), max(opts.NThreads, 1),
+		opts.MaxMemory, format.maxSize)
+	ranges := make([]lineRange, nThreads)
+	for t_i := range ranges {
+		ranges[t_i] = lineRange{int64(t_i) * t_chunk_size, int64(t_i+1) * t_chunk_size}
+	}
+	return ranges, int64(chunk_size)
+}
+
+// scanLines calls line for each line of lines in order, without its \n, the BOM of the file is skipped.
+// A line without \n in the read buffer is passed truncated with tooLong, then skipped
+func scanLines(fileReader FileReader, lines lineRange, chunk_size int64, format *lineFormat, line func(line []byte, offset int64, tooLong bool)) error {
+	size := fileReader.GetSize()
+	buff := make([]byte, lazyBufferSize(chunk_size, format.maxSize))
+	offset := lines.start
+	skipping := lines.start > 0 // up to the first \n
+	if lines.start == 0 && hasBOM(fileReader) {
+		offset = int64(len(utf8BOM))
+	}
+	for offset < size {
+		_n, err := fileReader.ReadChunk(buff[:min(int64(len(buff)), size-offset)], offset)
+		if err != nil {
+			return err
+		}
+		n := int(_n)
+		if n == 0 {
+			return fmt.Errorf("Cannot read at byte %d of %d", offset, size)
+		}
+		pos := 0
+		for pos < n {
+			lineStart := offset + int64(pos)
+			if !skipping && lineStart > lines.end {
+				return nil
+			}
+			nl := bytes.IndexByte(buff[pos:n], '\n')
+			if nl < 0 {
+				if offset+int64(n) >= size { // last line without \n
+					if !skipping {
+						line(buff[pos:n], lineStart, false)
+					}
+					return nil
+				}
+				if pos > 0 { // read again from the line start
+					break
+				}
+				if !skipping {
+					line(buff[:n], lineStart, true)
+				}
+				skipping = true
+				pos = n
+				break
+			}
+			if skipping {
+				skipping = false
+			} else {
+				line(buff[pos:pos+nl], lineStart, false)
+			}
+			pos += nl + 1
+		}
+		offset += int64(pos)
+	}
 	return nil
 }
 
-func asyncLazyRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, stationMap MapStation) {
+// parseLinesInBudget calls parse and accounts new stations, returns false on a parse error or when over budget.
+// With a shared table or spills, the thread map is flushed or spilled when it is full
+func parseLinesInBudget(line []byte, stationMap MapStation, format *lineFormat, budget *memoryBudget, stats *WorkerStats) bool {
+	timeBefore := time.Now()
+	nStations := len(stationMap)
+	stats.err = format.parse(line, stationMap, stats.arena)
+	newStations := len(stationMap) - nStations
+	switch {
+	case stats.err != nil:
+	case stats.shared != nil:
+		newStations = 0
+		if len(stationMap) >= sharedFlushSize {
+			newStations = stats.flush(stationMap)
+		}
+	case stats.spill != nil:
+		newStations = 0
+		if len(stationMap) >= stats.spill.maxStations {
+			stats.err = stats.spillMap(stationMap)
+		}
+	}
+	stats.addParse(timeBefore)
+	return stats.err == nil && budget.growStations(newStations)
+}
+
+func asyncLazyRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, stationMap MapStation, format *lineFormat, budget *memoryBudget, stats *WorkerStats) {
 	t_offset_start := t_i * t_chunk_size
-	buff := make([]byte, max(chunk_size*2, MAX_LINE_SIZE*2))
+	buff := make([]byte, lazyBufferSize(chunk_size, format.maxSize))
 	var totalRead int64 = 0
 	if t_i != 0 { // only if thread starts in the middle, start next line
-		n, _ := fileReader.ReadChunk(buff[:chunk_size], t_offset_start)
+		timeBefore := time.Now()
+		n, _ := fileReader.ReadChunk(buff[:max(chunk_size, format.maxSize)], t_offset_start)
+		stats.addRead(timeBefore, n)
 		totalRead = int64(findIndexOf(buff[:n], patternNl)) + 1
-		if totalRead == 0 { // can happen for high nTthreads vs low chunkSize
+		if totalRead == 0 { // the line ends the file, parsed by the previous thread, or is too long
+			if t_offset_start+n < fileReader.GetSize() {
+				stats.err = format.lineSizeError(t_offset_start)
+			}
 			return
 		}
 		if t_offset_start+totalRead >= fileReader.GetSize() { // useless thread
 			return
 		}
+	} else if hasBOM(fileReader) {
+		totalRead = int64(len(utf8BOM))
 	}
 	var buff_offset int64 = 0 // keeps track of remaining data after each read
 	for totalRead < t_chunk_size {
 		// ajust buffer to only read what we need
 		buff_end_offset := buff_offset + min(chunk_size, t_chunk_size-totalRead)
+		timeBefore := time.Now()
 		_n, _ := fileReader.ReadChunk(buff[buff_offset:buff_end_offset], t_offset_start+totalRead)
+		stats.addRead(timeBefore, _n)
 		if _n == 0 {
 			break
 		}
@@ -96,48 +362,77 @@ func asyncLazyRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, s
 			}
 		}
 		pos += 1
-		if pos > MIN_LINE_SIZE-1 {
-			ParseLines(buff[:pos], stationMap)
+		if pos > format.minSize-1 {
+			if !parseLinesInBudget(buff[:pos], stationMap, format, budget, stats) {
+				return
+			}
 		} // else we are at end of t_chunk_size, treated after the loop
 		buff_offset = buff_end_offset - pos
+		// the remaining data is the start of a line, it must fit with the next chunk in buff
+		if buff_offset > format.maxSize-1 {
+			stats.err = format.lineSizeError(t_offset_start + totalRead - buff_offset)
+			return
+		}
 		copy(buff, buff[pos:buff_end_offset])
 	}
-	if t_offset_start+totalRead < fileReader.GetSize()-1 { // all but last thread when not at end of file
-		// For the last line always read a MAX_LINE_SIZE up to the next \n,
+	if t_offset_start+totalRead < fileReader.GetSize() { // all but last thread when not at end of file
+		// For the last line always read a max line size up to the next \n,
 		// even if we are on a \n. This way, we know each line will be parsed once,
 		// and threads can be independant
-		_, _ = fileReader.ReadChunk(buff[buff_offset:min(buff_offset+MAX_LINE_SIZE, int64(len(buff)))], t_offset_start+totalRead)
-		lastNl := int64(findIndexOf(buff, patternNl)) + 1
-		if lastNl > MIN_LINE_SIZE {
-			ParseLines(buff[:lastNl], stationMap)
+		timeBefore := time.Now()
+		n, _ := fileReader.ReadChunk(buff[buff_offset:buff_offset+format.maxSize], t_offset_start+totalRead)
+		stats.addRead(timeBefore, n)
+		// only search in what was read, the end of buff has lines from previous reads
+		lastNl := int64(findIndexOf(buff[:buff_offset+n], patternNl)) + 1
+		atEnd := t_offset_start+totalRead+n >= fileReader.GetSize()
+		switch {
+		case lastNl > format.maxSize || (lastNl == 0 && !atEnd):
+			stats.err = format.lineSizeError(t_offset_start + totalRead - buff_offset)
+		case lastNl > format.minSize-1:
+			timeBefore = time.Now()
+			stats.err = format.parse(buff[:lastNl], stationMap, stats.arena)
+			stats.addParse(timeBefore)
+		case lastNl == 0:
+			parseLastLine(buff[:buff_offset+n], t_offset_start+totalRead-buff_offset, stationMap, format, stats)
 		}
+	} else if buff_offset > 0 { // end of file without a final \n
+		parseLastLine(buff[:buff_offset], t_offset_start+totalRead-buff_offset, stationMap, format, stats)
 	}
 }
 
-func asyncPreRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, stationMap MapStation) {
+func asyncPreRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, stationMap MapStation, format *lineFormat, budget *memoryBudget, stats *WorkerStats) {
 	t_offset_start := t_i * t_chunk_size
 	// buffLen := max(chunk_size * 2)
-	var buff []byte
 	var pos int64
 	buff_offset := t_offset_start // where to start in the file
 	if t_offset_start != 0 {      // only if thread starts in the middle, start next line
-		buff, n := fileReader.GetChunk(buff_offset, MAX_LINE_SIZE)
+		timeBefore := time.Now()
+		buff, n := fileReader.GetChunk(buff_offset, format.maxSize)
+		stats.addRead(timeBefore, n)
 		totalRead := int64(findIndexOf(buff[:n], patternNl)) + 1
-		if totalRead == 0 { // can happen for high nTthreads vs low chunkSize
+		if totalRead == 0 { // the line ends the file, parsed by the previous thread, or is too long
+			if t_offset_start+n < fileReader.GetSize() {
+				stats.err = format.lineSizeError(t_offset_start)
+			}
 			return
 		}
 		if t_offset_start+totalRead >= fileReader.GetSize() { // useless thread
 			return
 		}
 		buff_offset += totalRead
+	} else if hasBOM(fileReader) {
+		buff_offset += int64(len(utf8BOM))
 	}
+	readSize := max(chunk_size, format.maxSize) // a complete line always fits in a read
 	for {
 		// ajust buffer to only read what we need
-		sizeToRead := min(chunk_size, t_chunk_size-(buff_offset-t_offset_start))
-		if sizeToRead < MIN_LINE_SIZE {
+		sizeToRead := min(readSize, t_chunk_size-(buff_offset-t_offset_start))
+		if sizeToRead < format.minSize {
 			break
 		}
+		timeBefore := time.Now()
 		buff, n := fileReader.GetChunk(buff_offset, sizeToRead)
+		stats.addRead(timeBefore, n)
 		if n < sizeToRead {
 			// if we read less than expected (end of file or end of t_chunk)
 			// we need to adjust slice, else we can find NL from previous lines
@@ -150,21 +445,35 @@ func asyncPreRead(fileReader FileReader, chunk_size, t_i, t_chunk_size int64, st
 			}
 		}
 		pos += 1
-		if pos > MIN_LINE_SIZE {
-			ParseLines(buff[:pos], stationMap)
+		if pos > format.minSize-1 {
+			if !parseLinesInBudget(buff[:pos], stationMap, format, budget, stats) {
+				return
+			}
 			buff_offset += pos
+		} else if sizeToRead == readSize {
+			stats.err = format.lineSizeError(buff_offset)
+			return
 		} else {
 			break
 		}
 	}
 	if buff_offset < fileReader.GetSize()-1 { // all but last thread when not at end of file
-		// For the last line always read a MAX_LINE_SIZE up to the next \n,
+		// For the last line always read a max line size up to the next \n,
 		// even if we are on a \n. This way, we know each line will be parsed once,
 		// and threads can be independant
-		buff, _ = fileReader.GetChunk(buff_offset, buff_offset+MAX_LINE_SIZE)
-		lastNl := int64(findIndexOf(buff, patternNl)) + 1
-		if lastNl > MIN_LINE_SIZE-1 {
-			ParseLines(buff[:lastNl], stationMap)
+		timeBefore := time.Now()
+		buff, n := fileReader.GetChunk(buff_offset, format.maxSize)
+		stats.addRead(timeBefore, n)
+		lastNl := int64(findIndexOf(buff[:n], patternNl)) + 1
+		switch {
+		case lastNl == 0 && buff_offset+n < fileReader.GetSize():
+			stats.err = format.lineSizeError(buff_offset)
+		case lastNl > format.minSize-1:
+			timeBefore = time.Now()
+			stats.err = format.parse(buff[:lastNl], stationMap, stats.arena)
+			stats.addParse(timeBefore)
+		case lastNl == 0: // end of file without a final \n
+			parseLastLine(buff[:n], buff_offset, stationMap, format, stats)
 		}
 	}
 }
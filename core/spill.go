@@ -0,0 +1,265 @@
+package brc
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// spillPartitions is the number of hash partitions of the spilled stations, each one is merged in memory
+const spillPartitions = 256
+
+// spillHeaderSize is the size of a spilled station before its name: key, first, min, max, sum, size, name length
+const spillHeaderSize = 6*8 + 4
+
+// spillSegment is where the stations of a partition are in a run file
+type spillSegment struct {
+	offset int64
+	size   int64
+}
+
+// spillRun is the run file of a thread, each spill appends one segment per partition
+type spillRun struct {
+	file     *os.File
+	offset   int64
+	segments [spillPartitions][]spillSegment
+}
+
+// spillRuns is an external aggregation: threads spill their map to their run file when it has maxStations.
+// Each partition is then merged from all run files and sorted in its own file, and the sorted partitions
+// are merged in the output
+type spillRuns struct {
+	dir         string
+	maxStations int
+	runs        []spillRun
+}
+
+// newSpillRuns creates the directory of the run files in parentDir, os.TempDir() if empty
+func newSpillRuns(parentDir string) (*spillRuns, error) {
+	dir, err := os.MkdirTemp(parentDir, "brc-spill-")
+	if err != nil {
+		return nil, err
+	}
+	return &spillRuns{dir: dir}, nil
+}
+
+// close removes all the run files
+func (spill *spillRuns) close() error {
+	for _, run := range spill.runs {
+		if run.file != nil {
+			run.file.Close()
+		}
+	}
+	return os.RemoveAll(spill.dir)
+}
+
+func (spill *spillRuns) sortedPath(partition int) string {
+	return filepath.Join(spill.dir, fmt.Sprintf("sorted-%d.run", partition))
+}
+
+func appendStation(buff []byte, key uint64, station *StationData) []byte {
+	buff = binary.LittleEndian.AppendUint64(buff, key)
+	buff = binary.LittleEndian.AppendUint64(buff, uint64(station.First))
+	buff = binary.LittleEndian.AppendUint64(buff, math.Float64bits(station.Min))
+	buff = binary.LittleEndian.AppendUint64(buff, math.Float64bits(station.Max))
+	buff = binary.LittleEndian.AppendUint64(buff, math.Float64bits(station.Sum))
+	buff = binary.LittleEndian.AppendUint64(buff, uint64(station.Size))
+	buff = binary.LittleEndian.AppendUint32(buff, uint32(len(station.Name)))
+	return append(buff, station.Name...)
+}
+
+// readStation reads a station of appendStation, io.EOF at the end of r
+func readStation(r *bufio.Reader) (uint64, *StationData, error) {
+	var header [spillHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	station := &StationData{
+		First: int64(binary.LittleEndian.Uint64(header[8:])),
+		Min:   math.Float64frombits(binary.LittleEndian.Uint64(header[16:])),
+		Max:   math.Float64frombits(binary.LittleEndian.Uint64(header[24:])),
+		Sum:   math.Float64frombits(binary.LittleEndian.Uint64(header[32:])),
+		Size:  int(binary.LittleEndian.Uint64(header[40:])),
+		Name:  make([]byte, binary.LittleEndian.Uint32(header[48:])),
+	}
+	if _, err := io.ReadFull(r, station.Name); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return binary.LittleEndian.Uint64(header[:]), station, nil
+}
+
+// spill appends a thread map to the run file of the thread, one segment per partition, and clears it.
+// First is offset by firstBase, the stations of the previous spills, and encodes the thread like mergeMaps
+func (spill *spillRuns) spill(stationMap MapStation, thread int, firstBase int64) error {
+	run := &spill.runs[thread]
+	if run.file == nil {
+		file, err := os.Create(filepath.Join(spill.dir, fmt.Sprintf("thread-%d.run", thread)))
+		if err != nil {
+			return err
+		}
+		run.file = file
+	}
+	buckets := make([][]keyedStation, spillPartitions)
+	for key, station := range stationMap {
+		p := key % spillPartitions
+		buckets[p] = append(buckets[p], keyedStation{key, station})
+	}
+	w := bufio.NewWriterSize(run.file, 1<<20)
+	var buff []byte
+	for p, bucket := range buckets {
+		start := run.offset
+		for _, s := range bucket {
+			s.station.First = int64(thread)<<firstThreadShift | (firstBase + s.station.First)
+			buff = appendStation(buff[:0], s.key, s.station)
+			if _, err := w.Write(buff); err != nil {
+				return err
+			}
+			run.offset += int64(len(buff))
+		}
+		if run.offset > start {
+			run.segments[p] = append(run.segments[p], spillSegment{start, run.offset - start})
+		}
+	}
+	clear(stationMap)
+	return w.Flush()
+}
+
+// sortPartitions merges and sorts the partitions in nThreads goroutines
+func (spill *spillRuns) sortPartitions(compare func(a, b *StationData) int, nThreads int) error {
+	errs := make([]error, nThreads)
+	var wg sync.WaitGroup
+	for t := range nThreads {
+		wg.Go(func() {
+			for p := t; p < spillPartitions && errs[t] == nil; p += nThreads {
+				errs[t] = spill.sortPartition(p, compare)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// sortPartition merges the segments of a partition in all run files, with mergeMaps semantics,
+// and writes its stations sorted in its own file
+func (spill *spillRuns) sortPartition(partition int, compare func(a, b *StationData) int) error {
+	merged := make(map[uint64]*StationData)
+	var stationLst []*StationData
+	for _, run := range spill.runs {
+		for _, segment := range run.segments[partition] {
+			r := bufio.NewReader(io.NewSectionReader(run.file, segment.offset, segment.size))
+			for {
+				key, station, err := readStation(r)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				v, ok := merged[key]
+				if !ok {
+					merged[key] = station
+					stationLst = append(stationLst, station)
+					continue
+				}
+				mergeStation(v, station)
+				v.First = min(v.First, station.First)
+			}
+		}
+	}
+	slices.SortFunc(stationLst, compare)
+	file, err := os.Create(spill.sortedPath(partition))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	var buff []byte
+	for _, station := range stationLst {
+		buff = appendStation(buff[:0], 0, station)
+		if _, err := w.Write(buff); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// sortedRun is the next station of a sorted partition file
+type sortedRun struct {
+	station *StationData
+	r       *bufio.Reader
+}
+
+// sortedRunsHeap is a container/heap of sorted partitions, by their next station
+type sortedRunsHeap struct {
+	runs    []sortedRun
+	compare func(a, b *StationData) int
+}
+
+func (h *sortedRunsHeap) Len() int { return len(h.runs) }
+func (h *sortedRunsHeap) Less(i, j int) bool {
+	return h.compare(h.runs[i].station, h.runs[j].station) < 0
+}
+func (h *sortedRunsHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *sortedRunsHeap) Push(x any)    { h.runs = append(h.runs, x.(sortedRun)) }
+func (h *sortedRunsHeap) Pop() any {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
+
+// writeSorted merges the sorted partitions into the output, one station at a time.
+// Returns the number of stations and lines
+func (spill *spillRuns) writeSorted(writer *stationWriter, compare func(a, b *StationData) int) (int, int64, error) {
+	h := &sortedRunsHeap{compare: compare}
+	for p := range spillPartitions {
+		file, err := os.Open(spill.sortedPath(p))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer file.Close()
+		r := bufio.NewReader(file)
+		_, station, err := readStation(r)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		h.runs = append(h.runs, sortedRun{station, r})
+	}
+	heap.Init(h)
+	stations, lines := 0, int64(0)
+	for h.Len() > 0 {
+		run := &h.runs[0]
+		if err := writer.write(run.station); err != nil {
+			return stations, lines, err
+		}
+		stations++
+		lines += int64(run.station.Size)
+		_, station, err := readStation(run.r)
+		switch {
+		case err == io.EOF:
+			heap.Pop(h)
+		case err != nil:
+			return stations, lines, err
+		default:
+			run.station = station
+			heap.Fix(h, 0)
+		}
+	}
+	return stations, lines, nil
+}
@@ -0,0 +1,240 @@
+package brc
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+type BrcTableType string
+
+const (
+	BrcTableAuto   BrcTableType = "auto"   // shared for a high estimated cardinality, thread otherwise
+	BrcTableThread BrcTableType = "thread" // one MapStation per thread, merged at the end
+	BrcTableShared BrcTableType = "shared" // one sharded table for all threads
+)
+
+var BrcTableList = []BrcTableType{BrcTableAuto, BrcTableThread, BrcTableShared}
+
+const sharedShards = 256
+
+// sharedFlushSize is the number of stations of a thread map moved to the shared table at once
+const sharedFlushSize = 1 << 14
+
+// sharedTableMin is the estimated number of station records of all threads from which auto uses the shared table
+const sharedTableMin = 1 << 22
+
+// sharedStation is a StationData updated concurrently, floats are stored as bits
+type sharedStation struct {
+	name  []byte
+	min   atomic.Uint64
+	max   atomic.Uint64
+	sum   atomic.Uint64
+	size  atomic.Int64
+	first atomic.Int64
+}
+
+// sharedTable is the station table of all threads: a shard lock protects its map,
+// the stations are updated with atomics
+type sharedTable struct {
+	shards [sharedShards]struct {
+		mu       sync.RWMutex
+		stations map[uint64]*sharedStation
+	}
+}
+
+// newSharedTable presizes the shards for the estimated stations
+func newSharedTable(stations int64) *sharedTable {
+	table := &sharedTable{}
+	for i := range table.shards {
+		table.shards[i].stations = make(map[uint64]*sharedStation, stations/sharedShards)
+	}
+	return table
+}
+
+// len is the number of stations in the table, once all threads flushed
+func (table *sharedTable) len() int64 {
+	n := 0
+	for i := range table.shards {
+		n += len(table.shards[i].stations)
+	}
+	return int64(n)
+}
+
+// updateFloat applies f to a float stored as bits until no other thread changed it meanwhile
+func updateFloat(v *atomic.Uint64, f func(old float64) (float64, bool)) {
+	for {
+		old := v.Load()
+		value, ok := f(math.Float64frombits(old))
+		if !ok || v.CompareAndSwap(old, math.Float64bits(value)) {
+			return
+		}
+	}
+}
+
+func (s *sharedStation) add(station *StationData, first int64) {
+	s.size.Add(int64(station.Size))
+	updateFloat(&s.sum, func(old float64) (float64, bool) { return old + station.Sum, true })
+	updateFloat(&s.min, func(old float64) (float64, bool) { return station.Min, station.Min < old })
+	updateFloat(&s.max, func(old float64) (float64, bool) { return station.Max, station.Max > old })
+	for {
+		old := s.first.Load()
+		if first >= old || s.first.CompareAndSwap(old, first) {
+			return
+		}
+	}
+}
+
+// flush moves the stations of a thread map to the table and clears it.
+// First of the thread map is offset by firstBase, the stations of its previous flushes.
+// Returns the number of stations new in the table
+func (table *sharedTable) flush(stationMap MapStation, thread int, firstBase int64) int {
+	added := 0
+	for key, station := range stationMap {
+		first := int64(thread)<<firstThreadShift | (firstBase + station.First)
+		shard := &table.shards[key%sharedShards]
+		shard.mu.RLock()
+		s, ok := shard.stations[key]
+		shard.mu.RUnlock()
+		if !ok {
+			shard.mu.Lock()
+			if s, ok = shard.stations[key]; !ok {
+				// the name is not used by the thread map anymore
+				s = &sharedStation{name: station.Name}
+				s.min.Store(math.Float64bits(math.Inf(1)))
+				s.max.Store(math.Float64bits(math.Inf(-1)))
+				s.first.Store(math.MaxInt64)
+				shard.stations[key] = s
+				added++
+			}
+			shard.mu.Unlock()
+		}
+		s.add(station, first)
+	}
+	clear(stationMap)
+	return added
+}
+
+// sortedStations appends the stations to dst in order: nParts goroutines sort a part of the shards each,
+// then the parts are merged
+func (table *sharedTable) sortedStations(dst []*StationData, compare func(a, b *StationData) int, nParts int) []*StationData {
+	parts := make([][]*StationData, nParts)
+	var wg sync.WaitGroup
+	for p := range parts {
+		wg.Go(func() {
+			for i := p; i < sharedShards; i += nParts {
+				for _, s := range table.shards[i].stations {
+					parts[p] = append(parts[p], &StationData{
+						Name:  s.name,
+						Min:   math.Float64frombits(s.min.Load()),
+						Max:   math.Float64frombits(s.max.Load()),
+						Sum:   math.Float64frombits(s.sum.Load()),
+						Size:  int(s.size.Load()),
+						First: s.first.Load(),
+					})
+				}
+			}
+			slices.SortFunc(parts[p], compare)
+		})
+	}
+	wg.Wait()
+	return mergeSorted(dst, parts, compare)
+}
+
+// cardinality is the estimated number of unique stations and lines of a file
+type cardinality struct {
+	stations int64
+	lines    int64
+}
+
+// estimateCardinality scans the keys of nSamples line aligned ranges of sampleSize bytes spread over the file,
+// and estimates its number of unique stations and of lines. The keys of the first and second half of the samples
+// are counted in a hyperLogLog each: the share of the keys of the second half not seen in the first half
+// is exp(-lines/stations) when keys are spread uniformly, lines being the lines of the first half.
+// The unique stations of the whole file are those of its lines drawn from this distribution
+func estimateCardinality(fileReader FileReader, format *lineFormat, nSamples int, sampleSize int64) cardinality {
+	size := fileReader.GetSize()
+	whole := size <= int64(nSamples)*sampleSize
+	if whole { // samples would overlap, read all
+		nSamples, sampleSize = 1, size
+	}
+	buff := make([]byte, sampleSize)
+	halves := new([2]hyperLogLog)
+	var sampled, lines [2]int64
+	for i := range int64(nSamples) {
+		half := 2 * i / int64(nSamples)
+		offset := size * i / int64(nSamples)
+		n, _ := fileReader.ReadChunk(buff, offset)
+		sample := buff[:n]
+		if offset > 0 {
+			sample = sample[findIndexOf(sample, patternNl)+1:]
+		}
+		for {
+			end := bytes.IndexByte(sample, '\n')
+			if end < 0 { // the line ends after the sample
+				break
+			}
+			sep := bytes.IndexByte(sample[:end], ';')
+			if sep < 0 || sep > format.maxKeySize { // a bad line only ends the sample, parseFile reports it
+				break
+			}
+			halves[half].add(getHashFromBytes(sample[:sep]))
+			lines[half]++
+			sampled[half] += int64(end + 1)
+			sample = sample[end+1:]
+		}
+		if offset+int64(n) >= size {
+			break
+		}
+	}
+	sampledSize := sampled[0] + sampled[1]
+	if sampledSize == 0 {
+		return cardinality{}
+	}
+	union := halves[0]
+	union.merge(&halves[1])
+	stations := union.estimate()
+	if whole {
+		return cardinality{stations, lines[0]}
+	}
+	fileLines := (lines[0] + lines[1]) * size / sampledSize
+	// at most, the stations of the samples are all unique in the file
+	linear := stations * size / sampledSize
+	unseen := float64(stations-halves[0].estimate()) / float64(max(1, halves[1].estimate()))
+	switch {
+	case unseen >= 1:
+		return cardinality{linear, fileLines}
+	case unseen <= 0:
+		return cardinality{stations, fileLines}
+	}
+	// stations of the file, from the ones of the uniform distribution
+	uniform := -float64(lines[0]) / math.Log(unseen)
+	uniform *= -math.Expm1(-float64(fileLines) / uniform)
+	return cardinality{min(max(int64(uniform), stations), linear), fileLines}
+}
+
+// threadStations estimates the stations of a thread map, with the lines of the file split in nThreads ranges:
+// from stations/nThreads if they are all unique to stations if each one is on many lines
+func (estimated cardinality) threadStations(nThreads int) int64 {
+	if estimated.stations <= 0 {
+		return 0
+	}
+	threadLines := float64(estimated.lines) / float64(nThreads)
+	stations := float64(estimated.stations)
+	return max(estimated.stations/int64(nThreads), int64(-stations*math.Expm1(-threadLines/stations)))
+}
+
+// useSharedTable chooses the station table of opts.Table, auto is shared when the thread maps would hold
+// more than sharedTableMin stations, or would not fit in the memory budget
+func useSharedTable(opts BrcOptions, estimated int64) bool {
+	switch opts.Table {
+	case BrcTableShared:
+		return true
+	case BrcTableThread:
+		return false
+	}
+	records := estimated * int64(opts.NThreads)
+	return opts.NThreads > 1 && (records >= sharedTableMin || (opts.MaxMemory > 0 && records*stationMemSize > opts.MaxMemory/2))
+}
@@ -0,0 +1,144 @@
+package brc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type traceSpan struct {
+	name  string
+	start time.Time
+	dur   time.Duration
+}
+
+// WorkerStats are the measures of one parseFile thread
+type WorkerStats struct {
+	Id        int
+	Start     int64 // byte range [Start, End) assigned to the thread
+	End       int64
+	BytesRead int64
+	Lines     int64
+	Stations  int
+	IOTime    time.Duration // ReadChunk for lazy, GetChunk for preload
+	ParseTime time.Duration
+	spans     []traceSpan // only when tracing
+	tracing   bool
+	progress  *atomic.Int64 // bytes read by all threads, for RunMetrics
+	err       error         // parse error or line over the size limits, ends the thread
+	shared    *sharedTable  // if set, the thread map is flushed in it
+	spill     *spillRuns    // if set, the thread map is spilled in it
+	firstBase int64         // stations of the previous flushes or spills, added to First
+	arena     *stationArena // names and records of the thread map
+	keys      *hyperLogLog  // unique stations of the thread map, without table or spill
+}
+
+// countFlushed counts the stations and lines of the thread map before it is cleared
+func (stats *WorkerStats) countFlushed(stationMap MapStation) {
+	for _, station := range stationMap {
+		stats.Lines += int64(station.Size)
+	}
+	stats.Stations += len(stationMap)
+}
+
+// flush moves the thread map to the shared table, returns the number of stations new in the table
+func (stats *WorkerStats) flush(stationMap MapStation) int {
+	stats.countFlushed(stationMap)
+	n := len(stationMap)
+	added := stats.shared.flush(stationMap, stats.Id, stats.firstBase)
+	stats.firstBase += int64(n)
+	stats.arena.resetRecords() // names are used by the table
+	return added
+}
+
+// spillMap writes the thread map to its run file
+func (stats *WorkerStats) spillMap(stationMap MapStation) error {
+	stats.countFlushed(stationMap)
+	n := len(stationMap)
+	err := stats.spill.spill(stationMap, stats.Id, stats.firstBase)
+	stats.firstBase += int64(n)
+	stats.arena.reset()
+	return err
+}
+
+func (stats *WorkerStats) addRead(start time.Time, n int64) {
+	dur := time.Since(start)
+	stats.BytesRead += n
+	stats.IOTime += dur
+	if stats.progress != nil {
+		stats.progress.Add(n)
+	}
+	if stats.tracing {
+		stats.spans = append(stats.spans, traceSpan{"read", start, dur})
+	}
+}
+
+func (stats *WorkerStats) addParse(start time.Time) {
+	dur := time.Since(start)
+	stats.ParseTime += dur
+	if stats.tracing {
+		stats.spans = append(stats.spans, traceSpan{"parse", start, dur})
+	}
+}
+
+// addSpan records a span run for the thread after its parse, like the merge of its partition
+func (stats *WorkerStats) addSpan(name string, start time.Time) {
+	if stats.tracing {
+		stats.spans = append(stats.spans, traceSpan{name, start, time.Since(start)})
+	}
+}
+
+// traceEvent is a complete event of the chrome trace event format, times are in µs
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type traceEvent struct {
+	Name string         `json:"name"`
+	Ph   string         `json:"ph"`
+	Ts   float64        `json:"ts"`
+	Dur  float64        `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// writeTrace writes the worker spans (tid=worker+1) and the main spans (tid=0) as a chrome trace,
+// to open in chrome://tracing or https://ui.perfetto.dev
+func writeTrace(filename string, origin time.Time, mainSpans []traceSpan, workers []WorkerStats) error {
+	events := []traceEvent{{Name: "thread_name", Ph: "M", Tid: 0, Pid: 1, Args: map[string]any{"name": "main"}}}
+	appendSpans := func(tid int, spans []traceSpan) {
+		for _, span := range spans {
+			events = append(events, traceEvent{
+				Name: span.name,
+				Ph:   "X",
+				Ts:   float64(span.start.Sub(origin).Nanoseconds()) / 1e3,
+				Dur:  float64(span.dur.Nanoseconds()) / 1e3,
+				Pid:  1,
+				Tid:  tid,
+			})
+		}
+	}
+	appendSpans(0, mainSpans)
+	for _, worker := range workers {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: 1, Tid: worker.Id + 1,
+			Args: map[string]any{"name": fmt.Sprintf("worker %d", worker.Id)}})
+		appendSpans(worker.Id+1, worker.spans)
+	}
+	data, err := json.Marshal(map[string]any{"traceEvents": events, "displayTimeUnit": "ms"})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// printWorkerStats writes a summary table of all workers
+func printWorkerStats(w io.Writer, workers []WorkerStats) {
+	fmt.Fprintf(w, "%6s %14s %14s %12s %12s %9s %12s %12s\n",
+		"worker", "start", "end", "read", "lines", "stations", "io", "parse")
+	for _, worker := range workers {
+		fmt.Fprintf(w, "%6d %14d %14d %12s %12d %9d %12s %12s\n",
+			worker.Id, worker.Start, worker.End, FormatByteSize(worker.BytesRead), worker.Lines,
+			worker.Stations, worker.IOTime.Round(time.Microsecond), worker.ParseTime.Round(time.Microsecond))
+	}
+}
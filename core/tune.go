@@ -0,0 +1,53 @@
+package brc
+
+import "time"
+
+type TuneResult struct {
+	Opts       BrcOptions
+	Duration   time.Duration // best duration of all repetitions
+	Throughput float64       // input bytes per second, for the best duration
+}
+
+// TuneGrid returns all combinations of the given values
+func TuneGrid(threads, chunks []int, readers []BrcReaderType, strategies []BrcStrategyType) []BrcOptions {
+	grid := make([]BrcOptions, 0, len(threads)*len(chunks)*len(readers)*len(strategies))
+	for _, reader := range readers {
+		for _, strategy := range strategies {
+			for _, nThreads := range threads {
+				for _, chunk := range chunks {
+					grid = append(grid, BrcOptions{
+						ReadChunkFactor: chunk,
+						NThreads:        nThreads,
+						Strategy:        strategy,
+						ReaderType:      reader,
+					})
+				}
+			}
+		}
+	}
+	return grid
+}
+
+// Tune runs Bench repeat times for each candidate and returns the fastest one (min time).
+// Outputs are written in tmpDir, onResult (can be nil) is called after each candidate
+func Tune(filename, tmpDir string, candidates []BrcOptions, repeat int, onResult func(TuneResult)) (TuneResult, error) {
+	var best TuneResult
+	for _, opts := range candidates {
+		report, err := Bench(filename, tmpDir, opts, repeat)
+		if err != nil {
+			return best, err
+		}
+		result := TuneResult{
+			Opts:       opts,
+			Duration:   time.Duration(report.MinTime * float64(time.Second)),
+			Throughput: float64(report.Bytes) / report.MinTime,
+		}
+		if onResult != nil {
+			onResult(result)
+		}
+		if best.Duration == 0 || result.Duration < best.Duration {
+			best = result
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,230 @@
+package brc
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// verifyExamples is the number of issues of each kind kept in a VerifyReport, the first ones of the file
+const verifyExamples = 10
+
+// VerifyOptions are the checks of Verify on top of the line format of BrcOptions
+type VerifyOptions struct {
+	MinValue, MaxValue float64 // values outside are reported as out of range, if MinValue < MaxValue
+}
+
+// VerifyIssue is an invalid line of the input
+type VerifyIssue struct {
+	Offset int64  `json:"offset"` // of the start of the line
+	Line   string `json:"line"`   // its first 64 bytes
+	Reason string `json:"reason"`
+}
+
+// VerifyIssues counts the lines of an issue, with the first ones
+type VerifyIssues struct {
+	Count    int64         `json:"count"`
+	Examples []VerifyIssue `json:"examples"`
+}
+
+func (issues *VerifyIssues) add(offset int64, line []byte, reason string) {
+	issues.Count++
+	if len(issues.Examples) < verifyExamples {
+		issues.Examples = append(issues.Examples, VerifyIssue{Offset: offset, Line: string(linePreview(line)), Reason: reason})
+	}
+}
+
+// merge adds the issues of a later part of the file
+func (issues *VerifyIssues) merge(other VerifyIssues) {
+	issues.Count += other.Count
+	issues.Examples = append(issues.Examples, other.Examples[:min(len(other.Examples), verifyExamples-len(issues.Examples))]...)
+}
+
+// Histogram is a distribution: Counts[i] are the values in [Bounds[i-1], Bounds[i]),
+// the first count is the values under Bounds[0] and the last one those over all bounds
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Count  int64     `json:"count"`
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Sum    float64   `json:"sum"`
+}
+
+func newHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) add(value float64) {
+	h.Counts[sort.Search(len(h.Bounds), func(i int) bool { return h.Bounds[i] > value })]++
+	if h.Count == 0 || value < h.Min {
+		h.Min = value
+	}
+	if h.Count == 0 || value > h.Max {
+		h.Max = value
+	}
+	h.Count++
+	h.Sum += value
+}
+
+func (h *Histogram) merge(other Histogram) {
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	if other.Count > 0 && (h.Count == 0 || other.Min < h.Min) {
+		h.Min = other.Min
+	}
+	if other.Count > 0 && (h.Count == 0 || other.Max > h.Max) {
+		h.Max = other.Max
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
+
+// Mean of the values, NaN without values
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return math.NaN()
+	}
+	return h.Sum / float64(h.Count)
+}
+
+// VerifyReport is the result of Verify. Malformed lines, names over the max key size and values
+// not in the number format are errors, solve fails or mis-parses them. Invalid UTF-8 names
+// and out of range values are warnings, solve accepts them
+type VerifyReport struct {
+	Number      BrcNumberType `json:"number"`
+	Bytes       int64         `json:"bytes"`
+	Lines       int64         `json:"lines"`
+	Malformed   VerifyIssues  `json:"malformed"`
+	LongNames   VerifyIssues  `json:"long_names"`
+	InvalidUTF8 VerifyIssues  `json:"invalid_utf8"`
+	OutOfRange  VerifyIssues  `json:"out_of_range"`
+	NameLengths Histogram     `json:"name_lengths"` // in bytes
+	Values      Histogram     `json:"values"`
+}
+
+func newVerifyReport(number BrcNumberType) *VerifyReport {
+	return &VerifyReport{
+		Number:      number,
+		NameLengths: newHistogram([]float64{2, 4, 8, 16, 32, 64, 128}),
+		Values:      newHistogram([]float64{-90, -80, -70, -60, -50, -40, -30, -20, -10, 0, 10, 20, 30, 40, 50, 60, 70, 80, 90}),
+	}
+}
+
+// Errors is the number of lines solve can't parse
+func (report *VerifyReport) Errors() int64 {
+	return report.Malformed.Count + report.LongNames.Count
+}
+
+// Warnings is the number of suspicious lines solve accepts
+func (report *VerifyReport) Warnings() int64 {
+	return report.InvalidUTF8.Count + report.OutOfRange.Count
+}
+
+func (report *VerifyReport) merge(other *VerifyReport) {
+	report.Lines += other.Lines
+	report.Malformed.merge(other.Malformed)
+	report.LongNames.merge(other.LongNames)
+	report.InvalidUTF8.merge(other.InvalidUTF8)
+	report.OutOfRange.merge(other.OutOfRange)
+	report.NameLengths.merge(other.NameLengths)
+	report.Values.merge(other.Values)
+}
+
+// Verify checks all lines of the file with the thread partitioning of parseFile, without aggregating them.
+// Only an error to read the file or invalid options are returned as an error, invalid lines are in the report
+func Verify(fileReader FileReader, opts BrcOptions, verify VerifyOptions) (*VerifyReport, error) {
+	format, err := newLineFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+	size := fileReader.GetSize()
+	report := newVerifyReport(format.number)
+	report.Bytes = size
+	if size == 0 {
+		return report, nil
+	}
+	ranges, chunk_size := lineRanges(size, opts, format)
+	reports := make([]*VerifyReport, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for t_i, lines := range ranges {
+		reports[t_i] = newVerifyReport(format.number)
+		wg.Go(func() {
+			errs[t_i] = scanLines(fileReader, lines, chunk_size, format, func(line []byte, offset int64, tooLong bool) {
+				if tooLong {
+					reports[t_i].Lines++
+					reports[t_i].Malformed.add(offset, line, fmt.Sprintf("longer than the max line size %d", format.maxSize))
+					return
+				}
+				verifyLine(line, offset, format, verify, reports[t_i])
+			})
+		})
+	}
+	wg.Wait()
+	for t_i, threadReport := range reports {
+		if errs[t_i] != nil {
+			return nil, errs[t_i]
+		}
+		report.merge(threadReport)
+	}
+	return report, nil
+}
+
+// verifyLine checks a line without its \n
+func verifyLine(line []byte, offset int64, format *lineFormat, verify VerifyOptions, report *VerifyReport) {
+	report.Lines++
+	if int64(len(line))+1 > format.maxSize {
+		report.Malformed.add(offset, line, fmt.Sprintf("longer than the max line size %d", format.maxSize))
+		return
+	}
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	sep := bytes.IndexByte(line, ';')
+	switch {
+	case sep < 0:
+		report.Malformed.add(offset, line, "no ';'")
+		return
+	case sep == 0:
+		report.Malformed.add(offset, line, "empty name")
+		return
+	}
+	name, value := line[:sep], line[sep+1:]
+	report.NameLengths.add(float64(len(name)))
+	if len(name) > format.maxKeySize {
+		report.LongNames.add(offset, line, fmt.Sprintf("name of %d bytes, over the max key size %d", len(name), format.maxKeySize))
+	}
+	if !utf8.Valid(name) {
+		report.InvalidUTF8.add(offset, line, "name is not valid UTF-8")
+	}
+	number := math.NaN()
+	if len(value) > 0 {
+		number = ParseNumber(value)
+	}
+	if math.IsNaN(number) {
+		report.Malformed.add(offset, line, "value is not a number")
+		return
+	}
+	if format.number != BrcNumberGeneral && !isFastValue(value) {
+		report.Malformed.add(offset, line, "value is not in the fast format (-99.9 to 99.9, one decimal)")
+		return
+	}
+	report.Values.add(number)
+	if verify.MinValue < verify.MaxValue && (number < verify.MinValue || number > verify.MaxValue) {
+		report.OutOfRange.add(offset, line, fmt.Sprintf("value out of [%g, %g]", verify.MinValue, verify.MaxValue))
+	}
+}
+
+// isFastValue returns true for -?d?d.d, the values parsed by ParseF64
+func isFastValue(value []byte) bool {
+	value = bytes.TrimPrefix(value, []byte{'-'})
+	dot := bytes.IndexByte(value, '.')
+	if dot < 1 || dot > 2 || len(value) != dot+2 {
+		return false
+	}
+	return !slices.ContainsFunc(value, func(c byte) bool { return c != '.' && (c < '0' || c > '9') })
+}
@@ -1,35 +1,185 @@
 package brc
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
-func writeData(filename string, stationLst []*StationData) error {
-	outFs, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o764)
+// snapTenths rounds a sum of values with one decimal, an exact multiple of 0.1, to remove
+// float errors: the result doesn't depend on the summation order (threads, chunks)
+func snapTenths(sum float64) float64 {
+	return math.Round(sum*10.0) / 10.0
+}
+
+// roundSignificant rounds to 12 significant digits, to remove the float errors of a sum of decimal values
+// before rounding half away from zero: a mean of 0.15 summed as 0.1499999999999999 is written 0.2, like snapTenths
+func roundSignificant(f float64) float64 {
+	var buff [32]byte
+	rounded, _ := strconv.ParseFloat(string(strconv.AppendFloat(buff[:0], f, 'g', 12, 64)), 64)
+	return rounded
+}
+
+// roundDecimals rounds f to a multiple of 1/scale half away from zero, after roundSignificant
+func roundDecimals(f, scale float64) float64 {
+	return math.Round(roundSignificant(f)*scale) / scale
+}
+
+// stationWriter writes {name=min/mean/max, ...} one station at a time.
+// exactTenths is true when all values have one decimal (BrcNumberFast)
+type stationWriter struct {
+	w           *bufio.Writer
+	precision   int
+	scale       float64
+	exactTenths bool
+	n           int                               // stations written
+	annotate    func(station *StationData) string // if set, written after the max of each station
+}
+
+func newStationWriter(w io.Writer, precision int, exactTenths bool) *stationWriter {
+	writer := &stationWriter{w: bufio.NewWriter(w), precision: precision, scale: math.Pow10(precision), exactTenths: exactTenths}
+	writer.w.WriteByte('{')
+	return writer
+}
+
+func (writer *stationWriter) write(station *StationData) error {
+	var mean float64
+	if writer.exactTenths {
+		sum := snapTenths(station.Sum)
+		mean = math.Round(sum/float64(station.Size)*100.0) / 100.0
+		mean = math.Round(mean*writer.scale) / writer.scale
+	} else {
+		mean = roundDecimals(station.Sum/float64(station.Size), writer.scale)
+	}
+	if mean == 0 { // no -0.0 for small negative means
+		mean = 0
+	}
+	// %f rounds half to even, min and max are rounded like the mean
+	minimum, maximum := roundDecimals(station.Min, writer.scale), roundDecimals(station.Max, writer.scale)
+	if writer.n > 0 {
+		writer.w.WriteString(", ")
+	}
+	writer.n++
+	precision := writer.precision
+	_, err := fmt.Fprintf(writer.w, "%s=%.*f/%.*f/%.*f", station.Name, precision, minimum, precision, mean, precision, maximum)
+	if err == nil && writer.annotate != nil {
+		_, err = writer.w.WriteString(writer.annotate(station))
+	}
+	return err
+}
+
+// close ends the output and flushes it
+func (writer *stationWriter) close() error {
+	writer.w.WriteString("}\n")
+	return writer.w.Flush()
+}
+
+// writeData writes {name=min/mean/max, ...} with precision decimals.
+// exactTenths is true when all values have one decimal (BrcNumberFast)
+func writeData(filename string, stationLst []*StationData, precision int, exactTenths bool) error {
+	out, err := createOutput(filename)
 	if err != nil {
 		return err
 	}
-	defer outFs.Close()
-	var buffer bytes.Buffer
-	buffer.WriteByte('{')
-	if len(stationLst) > 0 {
-		for i, station := range stationLst {
-			mean := math.Round(station.Sum/float64(station.Size)*100.0) / 100.0
-			mean = math.Round(mean*10.0) / 10.0
-			min := station.Min
-			max := station.Max
-			if i < len(stationLst)-1 {
-				fmt.Fprintf(&buffer, "%s=%.1f/%.1f/%.1f, ", station.Name, min, mean, max)
-			} else {
-				fmt.Fprintf(&buffer, "%s=%.1f/%.1f/%.1f", station.Name, min, mean, max)
-			}
+	defer out.abort()
+	writer := newStationWriter(out, precision, exactTenths)
+	for _, station := range stationLst {
+		if err := writer.write(station); err != nil {
+			return err
+		}
+	}
+	if err := writer.close(); err != nil {
+		return err
+	}
+	return out.commit()
+}
+
+// StdoutPath is the output path writing to stdout
+const StdoutPath = "-"
+
+// outputFile is a temporary file next to the output path, renamed to it once complete:
+// readers see the previous or the new output, never a partial one
+type outputFile struct {
+	*os.File
+	path   string
+	direct bool // stdout, a device or a pipe, written in place
+	done   bool // committed or aborted
+}
+
+// createOutput starts writing the output at path, or to stdout for StdoutPath
+func createOutput(path string) (*outputFile, error) {
+	if path == StdoutPath {
+		return &outputFile{File: os.Stdout, path: path, direct: true}, nil
+	}
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		// can't be replaced, e.g. /dev/null
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return nil, err
 		}
+		return &outputFile{File: file, path: path, direct: true}, nil
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create output %s: %w", path, err)
+	}
+	out := &outputFile{File: file, path: path}
+	if err := file.Chmod(0o764); err != nil {
+		out.abort()
+		return nil, err
+	}
+	return out, nil
+}
+
+// commit syncs the output to disk and renames it to its path
+func (out *outputFile) commit() error {
+	if out.done {
+		return nil
+	}
+	out.done = true
+	if out.direct {
+		return out.closeDirect()
+	}
+	err := out.Sync()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), out.path)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	// the rename is on disk once the directory is synced, not supported by all file systems
+	if dir, err := os.Open(filepath.Dir(out.path)); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
-	buffer.WriteByte('}')
-	buffer.WriteByte('\n')
-	outFs.Write(buffer.Bytes())
 	return nil
 }
+
+// abort removes the output if it was not committed, the previous one is kept
+func (out *outputFile) abort() {
+	if out.done {
+		return
+	}
+	out.done = true
+	if out.direct {
+		out.closeDirect()
+		return
+	}
+	out.Close()
+	os.Remove(out.Name())
+}
+
+func (out *outputFile) closeDirect() error {
+	if out.File == os.Stdout {
+		return nil
+	}
+	return out.Close()
+}
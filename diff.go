@@ -0,0 +1,37 @@
+package main
+
+import (
+	brc "brc/core"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// diffMain exits with exitOK if the results are equal, exitFailed if they differ
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brc diff [options] EXPECTED COMPUTED\n")
+		fs.PrintDefaults()
+	}
+	tolerance := fs.Float64("tolerance", 0, "Max absolute delta of min/mean/max/count to be considered equal")
+	quiet := fs.Bool("q", false, "Only set the exit code")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usageAndExit(fs, "expected 2 result files")
+	}
+	diffs, err := brc.DiffResultFiles(fs.Arg(0), fs.Arg(1), *tolerance)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	if !*quiet {
+		for _, diff := range diffs {
+			fmt.Println(diff.String())
+		}
+		fmt.Printf("%d differences\n", len(diffs))
+	}
+	os.Exit(exitFailed)
+}
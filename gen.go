@@ -0,0 +1,55 @@
+package main
+
+import (
+	brc "brc/core"
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func genMain(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	outputPath := fs.String("o", "", "Output file path, the expected result is written next to it with a .out extension")
+	expectedPath := fs.String("expected", "", "Expected result path (default=output with .txt replaced by .out, -=none)")
+	rows := fs.Int64("rows", 1_000_000_000, "Number of lines")
+	seed := fs.Uint64("seed", 1, "Random seed, same seed and options => same file")
+	stationsPath := fs.String("stations", "", "Station list, one name;mean[;stddev] per line (default=built-in list)")
+	stdDev := fs.Float64("stddev", 10, "Default standard deviation for -stations")
+	uniqueKeys := fs.Int("unique-keys", 0, "Use N keys named id1..idN instead of the station names")
+	edgeCases := fs.Bool("edge-cases", false, "Inject 100 bytes utf8 names and boundary values every 1000 lines")
+	nThreads := fs.Int("threads", runtime.NumCPU(), "Number of threads")
+	fs.Parse(args)
+	if len(*outputPath) == 0 {
+		usageAndExit(fs, "output is empty")
+	}
+	opts := brc.GenOptions{
+		Rows:       *rows,
+		Seed:       *seed,
+		UniqueKeys: *uniqueKeys,
+		EdgeCases:  *edgeCases,
+		NThreads:   *nThreads,
+	}
+	if len(*stationsPath) > 0 {
+		stations, err := brc.LoadGenStations(*stationsPath, *stdDev)
+		if err != nil {
+			stderrAndExit(err.Error())
+		}
+		opts.Stations = stations
+	}
+	expected := *expectedPath
+	if len(expected) == 0 {
+		expected = strings.TrimSuffix(*outputPath, ".txt") + ".out"
+	} else if expected == "-" {
+		expected = ""
+	}
+	timeBefore := time.Now()
+	if err := brc.Generate(*outputPath, expected, opts); err != nil {
+		stderrAndExit(err.Error())
+	}
+	fmt.Printf("Generated %d lines in %s in %s\n", opts.Rows, *outputPath, time.Since(timeBefore))
+	if len(expected) > 0 {
+		fmt.Printf("Expected result: %s\n", expected)
+	}
+}
@@ -2,106 +2,87 @@
 package main
 
 import (
-	brc "brc/core"
-	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"path"
-	"runtime"
-	"runtime/pprof"
-	"slices"
-	"time"
+	"strings"
 )
 
-func usageAndExit(msg string) {
+// exit codes of all commands, like diff(1)
+const (
+	exitOK     = 0
+	exitFailed = 1 // the check of the command failed: results differ, invalid lines
+	exitError  = 2 // usage or runtime error
+	// brc verify: all lines can be solved but some are suspicious, brc normalize: some lines were rejected
+	exitWarning = 3
+)
+
+func usageAndExit(fs *flag.FlagSet, msg string) {
 	fmt.Fprintf(os.Stderr, "error: %s\n", msg)
-	flag.Usage()
-	fmt.Println("Default output: ./output/input_name.out")
-	os.Exit(1)
+	fs.Usage()
+	os.Exit(exitError)
 }
 
 func stderrAndExit(msg string) {
 	fmt.Fprintf(os.Stderr, "error: %s\n", msg)
-	os.Exit(1)
+	os.Exit(exitError)
 }
 
-func main() {
-	if len(os.Args) < 1 {
-		usageAndExit("not enough argument")
-	}
-	inputPath := flag.String("input", "", "Input file path")
-	nThreads := flag.Int("threads", runtime.NumCPU(), "Max number of threads to use (default=number of cores)")
-	chunkSize := flag.Int("chunk", (1024*1024)/os.Getpagesize(), fmt.Sprintf("Chunk size per read (a factor of pagesize=%db, default=1Mb)", os.Getpagesize()))
-	readerMode := flag.String("reader", string(brc.BrcReaderDisk), "Read from disk or mmap the file first [disk,mmap]")
-	strategy := flag.String("mode", string(brc.BrcStrategyLazyRead), "Pre read all file or read as needed [preload,lazy]")
-	verbose := flag.Bool("v", false, "If off, not output on stdout")
-	profiling := flag.Bool("p", false, "Activate incode pprof CPU profiling")
-	flag.Parse()
-	if len(*inputPath) == 0 {
-		usageAndExit("input is empty")
-	}
-	if nThreads != nil && *nThreads < 1 {
-		usageAndExit("threads out of bound")
-	}
-	if chunkSize != nil && *chunkSize < 1 {
-		usageAndExit("chunk out of bound")
-	}
-	if !slices.Contains(brc.BrcStrategyList, brc.BrcStrategyType(*strategy)) {
-		usageAndExit("strategy unknown")
-	}
-	if !slices.Contains(brc.BrcReaderList, brc.BrcReaderType(*readerMode)) {
-		usageAndExit("mode unknown")
-	}
-	input_file := *inputPath
-	if _, err := os.Stat(input_file); errors.Is(err, os.ErrNotExist) {
-		stderrAndExit(fmt.Sprintf("Input file does not exists or is not accessible: %s", err.Error()))
-	}
-	err := os.Mkdir("output", 0o764)
-	if err != nil && !os.IsExist(err) {
-		stderrAndExit(fmt.Sprintf("Cannot create output folder: %s", err.Error()))
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []command{
+	{"solve", "Compute the min/mean/max of each station of an input file", solveMain},
+	{"verify", "Check the lines of an input file", verifyMain},
+	{"normalize", "Rewrite an input file in the fast format, rejecting unfixable lines", normalizeMain},
+	{"gen", "Generate an input file and its expected result", genMain},
+	{"bench", "Measure solve with several options", benchMain},
+	{"tune", "Find the fastest options on this host, used as defaults", tuneMain},
+	{"merge", "Merge result files with counts (OpenMetrics or approximate)", mergeMain},
+	{"diff", "Compare two result files", diffMain},
+	{"config", "Show the configuration of solve: brc config show [solve options]", configMain},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: brc COMMAND [options], brc -input FILE [options] is brc solve\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
 	}
-	output_file := path.Join("./output", path.Base(input_file)) + ".out"
-	opts := brc.BrcOptions{
-		NThreads:        *nThreads,
-		ReadChunkFactor: *chunkSize,
-		Strategy:        brc.BrcStrategyType(*strategy),
-		ReaderType:      brc.BrcReaderType(*readerMode),
-		Verbose:         *verbose,
+	fmt.Fprintf(os.Stderr, "\nbrc help COMMAND shows the options of a command.\n")
+	fmt.Fprintf(os.Stderr, "Exit codes: %d success, %d check failed (diff, verify), %d usage or runtime error, %d warnings only (verify, normalize)\n",
+		exitOK, exitFailed, exitError, exitWarning)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitError)
 	}
-	var fileReader brc.FileReader
-	switch opts.ReaderType {
-	case brc.BrcReaderMmap:
-		fileReader = brc.NewFileMmapReader()
-	case brc.BrcReaderDisk:
-		fileReader = brc.NewFileDiskReader()
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) == 0 {
+			usage()
+			return
+		}
+		name, args = args[0], []string{"-h"}
 	default:
-		stderrAndExit("unknown reader")
-	}
-	err = fileReader.Open(input_file)
-	if err != nil {
-		stderrAndExit(err.Error())
-	}
-	defer fileReader.Close()
-	if *profiling {
-		f, err := os.Create("cpu.pprof")
-		if err != nil {
-			stderrAndExit(err.Error())
+		if strings.HasPrefix(name, "-") {
+			// brc -input FILE, from before the commands
+			solveMain(os.Args[1:])
+			return
 		}
-		defer f.Close()
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-	}
-	timeBefore := time.Now()
-	err = brc.Solve(fileReader, output_file, opts)
-	timeAfter := time.Since(timeBefore)
-	if opts.Verbose {
-		fmt.Printf("Time taken total: %s\n", timeAfter.String())
 	}
-	if err != nil {
-		stderrAndExit(err.Error())
-	}
-	if opts.Verbose {
-		fmt.Fprintf(os.Stdout, "Output file: %s\n", output_file)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			cmd.run(args)
+			return
+		}
 	}
+	fmt.Fprintf(os.Stderr, "error: unknown command %s\n", name)
+	usage()
+	os.Exit(exitError)
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	brc "brc/core"
+	"flag"
+	"fmt"
+	"slices"
+)
+
+func mergeMain(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brc merge [options] RESULT...\n")
+		fmt.Fprintf(fs.Output(), "Results need counts: the -metrics files of solve, or approximate results\n")
+		fs.PrintDefaults()
+	}
+	outputPath := fs.String("o", brc.StdoutPath, "Merged result path (-=stdout)")
+	order := fs.String("order", string(brc.BrcOrderBytes), "Output order [bytes,natural,first,min,mean,max,count], aggregates are descending")
+	precision := fs.Int("precision", 1, "Decimals of the output")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usageAndExit(fs, "expected result files")
+	}
+	if !slices.Contains(brc.BrcOrderList, brc.BrcOrderType(*order)) {
+		usageAndExit(fs, "order unknown")
+	}
+	if *precision < 0 || *precision > 15 {
+		usageAndExit(fs, "precision out of bound")
+	}
+	opts := brc.BrcOptions{Order: brc.BrcOrderType(*order), Precision: *precision}
+	if *precision == 0 {
+		opts.Precision = brc.BrcPrecisionInteger
+	}
+	if err := brc.MergeResultFiles(fs.Args(), *outputPath, opts); err != nil {
+		stderrAndExit(err.Error())
+	}
+}
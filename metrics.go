@@ -0,0 +1,43 @@
+package main
+
+import (
+	brc "brc/core"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// writeMetricsFile writes the metrics in a temporary file renamed to filename,
+// so the node_exporter textfile collector never reads a partial file
+func writeMetricsFile(filename string, metrics *brc.RunMetrics) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".brc-metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := metrics.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// serveMetrics serves /metrics on addr in the background, fails if the address is not available
+func serveMetrics(addr string, metrics *brc.RunMetrics) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	brc "brc/core"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// normalizeMain rewrites the input in the canonical form of the fast format, exits with exitWarning if lines were rejected
+func normalizeMain(args []string) {
+	tuned, err := loadTuneConfig(defaultTuneConfigPath())
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	fs := flag.NewFlagSet("normalize", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brc normalize [options] INPUT OUTPUT (-=stdout)\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Exit codes: %d all lines written, %d error, %d some lines rejected\n", exitOK, exitError, exitWarning)
+	}
+	nThreads := fs.Int("threads", tuned.Threads, "Max number of threads to use (default=number of cores or tuned)")
+	chunkSize := fs.Int("chunk", tuned.Chunk, fmt.Sprintf("Chunk size per read (a factor of pagesize=%db, default=1Mb or tuned)", os.Getpagesize()))
+	readerMode := fs.String("reader", tuned.Reader, "Read from disk or mmap the file first [disk,mmap]")
+	maxKey := fs.Int("max-key", brc.MAX_KEY_SIZE, "Longest station name in bytes")
+	maxLine := fs.Int("max-line", 0, "Longest input line in bytes, \\n included (default=max-key+28)")
+	rejects := fs.String("rejects", "", "Write the rejected lines in this file, after their offset and reason (default=dropped)")
+	fs.String("config", "", "Config file of solve, for -threads, -chunk, -reader, -max-key, -max-line, overridden by BRC_* env variables and flags (default=$BRC_CONFIG)")
+	parseConfigured(fs, args, "threads", "chunk", "reader", "max-key", "max-line")
+	if fs.NArg() != 2 {
+		usageAndExit(fs, "expected an input and an output file")
+	}
+	if *nThreads < 1 || *chunkSize < 1 {
+		usageAndExit(fs, "threads or chunk out of bound")
+	}
+	if !slices.Contains(brc.BrcReaderList, brc.BrcReaderType(*readerMode)) {
+		usageAndExit(fs, "mode unknown")
+	}
+	if *maxKey < 1 || *maxLine < 0 {
+		usageAndExit(fs, "max-key or max-line out of bound")
+	}
+	fileReader, err := brc.NewFileReader(brc.BrcReaderType(*readerMode))
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if err := fileReader.Open(fs.Arg(0)); err != nil {
+		stderrAndExit(err.Error())
+	}
+	opts := brc.BrcOptions{
+		NThreads:        *nThreads,
+		ReadChunkFactor: *chunkSize,
+		ReaderType:      brc.BrcReaderType(*readerMode),
+		MaxKeySize:      *maxKey,
+		MaxLineSize:     *maxLine,
+	}
+	stats, err := brc.Normalize(fileReader, fs.Arg(1), *rejects, opts)
+	fileReader.Close()
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	// on stderr, the output may be stdout
+	fmt.Fprintf(os.Stderr, "%s: %d lines, %d written (%d fixed), %d rejected, %d blank\n",
+		fs.Arg(0), stats.Lines, stats.Written, stats.Fixed, stats.Rejected, stats.Blank)
+	if stats.Rejected > 0 {
+		os.Exit(exitWarning)
+	}
+}
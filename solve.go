@@ -0,0 +1,302 @@
+package main
+
+import (
+	brc "brc/core"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"runtime/pprof"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// solveCommand is a solve run, from its flags
+type solveCommand struct {
+	opts            brc.BrcOptions
+	input           string
+	output          string
+	metricsFile     string
+	metricsAddr     string
+	metricsStations bool
+	following       bool
+	follow          brc.FollowOptions
+	profiling       bool
+}
+
+// newSolveFlags defines the solve flags in a new flag set, the returned function validates them once parsed
+func newSolveFlags(name string) (*flag.FlagSet, func() solveCommand) {
+	// defaults come from `brc tune` if it was run on this host
+	tuned, err := loadTuneConfig(defaultTuneConfigPath())
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brc %s [options] [INPUT]\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "Default output: ./output/input_name.out")
+	}
+	fs.String("config", "", "Config file of these flags, JSON or key = value lines, overridden by BRC_* env variables and flags (default=$BRC_CONFIG)")
+	inputPath := fs.String("input", "", "Input file path, or the INPUT argument")
+	outputPath := fs.String("o", "", "Output file path, replaced once complete (-=stdout, default=./output/input_name.out)")
+	nThreads := fs.Int("threads", tuned.Threads, "Max number of threads to use (default=number of cores or tuned)")
+	chunkSize := fs.Int("chunk", tuned.Chunk, fmt.Sprintf("Chunk size per read (a factor of pagesize=%db, default=1Mb or tuned)", os.Getpagesize()))
+	readerMode := fs.String("reader", tuned.Reader, "Read from disk or mmap the file first [disk,mmap]")
+	strategy := fs.String("mode", tuned.Mode, "Pre read all file or read as needed [preload,lazy]")
+	maxMemory := fs.String("max-memory", "0", "Memory budget for buffers, preload and stations, e.g. 512M or 2G (0=unlimited)")
+	traceFile := fs.String("trace", "", "Write a chrome trace of all threads in this file, and print their stats on stderr")
+	metricsFile := fs.String("metrics", "", "Write run and station metrics in this file (OpenMetrics text format)")
+	metricsAddr := fs.String("metrics-addr", "", "Serve run and station metrics on http://ADDR/metrics during the run, e.g. localhost:9101")
+	metricsStations := fs.Bool("metrics-stations", true, "Add min/mean/max/count gauges per station to the metrics")
+	order := fs.String("order", string(brc.BrcOrderBytes), "Output order [bytes,natural,first,min,mean,max,count], aggregates are descending")
+	number := fs.String("number", string(brc.BrcNumberFast), "Values format: fast (-99.9 to 99.9, one decimal) or general (any decimal number, + and exponents) [fast,general]")
+	precision := fs.Int("precision", 1, "Decimals of the output")
+	table := fs.String("table", string(brc.BrcTableAuto), "Station table: one per thread, one shared by all threads for millions of stations, or auto from a sample [auto,thread,shared]")
+	spill := fs.String("spill", "0", "Spill thread maps to disk when their stations use more than this memory, e.g. 1G (0=never)")
+	spillDir := fs.String("spill-dir", "", "Directory of the spilled stations (default=system temp dir)")
+	sample := fs.Float64("sample", 0, "Parse only this fraction of the file, e.g. 0.05, for approximate results with confidence intervals (0=all)")
+	sampleSeed := fs.Uint64("sample-seed", 0, "Seed of the sampled blocks")
+	follow := fs.Bool("follow", false, "Keep parsing the lines appended to the input (disk reader), until interrupted")
+	followInterval := fs.Duration("follow-interval", 5*time.Second, "With -follow, rewrite the output at most this often")
+	followLines := fs.Int64("follow-lines", 0, "With -follow, also rewrite the output after this many new lines (0=interval only)")
+	maxKey := fs.Int("max-key", brc.MAX_KEY_SIZE, "Longest station name in bytes")
+	maxLine := fs.Int("max-line", 0, "Longest line in bytes, \\n included (default=max-key+28)")
+	verbose := fs.Bool("v", false, "If off, not output on stdout")
+	profiling := fs.Bool("p", false, "Activate incode pprof CPU profiling")
+	return fs, func() solveCommand {
+		if len(*inputPath) == 0 && fs.NArg() == 1 {
+			*inputPath = fs.Arg(0)
+		} else if fs.NArg() > 0 {
+			usageAndExit(fs, fmt.Sprintf("unexpected arguments %v", fs.Args()))
+		}
+		if len(*inputPath) == 0 {
+			usageAndExit(fs, "input is empty")
+		}
+		if *nThreads < 1 {
+			usageAndExit(fs, "threads out of bound")
+		}
+		if *chunkSize < 1 {
+			usageAndExit(fs, "chunk out of bound")
+		}
+		if !slices.Contains(brc.BrcStrategyList, brc.BrcStrategyType(*strategy)) {
+			usageAndExit(fs, "strategy unknown")
+		}
+		if !slices.Contains(brc.BrcReaderList, brc.BrcReaderType(*readerMode)) {
+			usageAndExit(fs, "mode unknown")
+		}
+		if !slices.Contains(brc.BrcOrderList, brc.BrcOrderType(*order)) {
+			usageAndExit(fs, "order unknown")
+		}
+		if !slices.Contains(brc.BrcNumberList, brc.BrcNumberType(*number)) {
+			usageAndExit(fs, "number format unknown")
+		}
+		if *precision < 0 || *precision > 15 {
+			usageAndExit(fs, "precision out of bound")
+		}
+		if !slices.Contains(brc.BrcTableList, brc.BrcTableType(*table)) {
+			usageAndExit(fs, "table unknown")
+		}
+		if *sample < 0 || *sample >= 1 {
+			usageAndExit(fs, "sample out of bound")
+		}
+		if *outputPath == brc.StdoutPath && (*verbose || *follow) {
+			usageAndExit(fs, "-o - can't be used with -v or -follow")
+		}
+		if *maxKey < 1 || *maxLine < 0 {
+			usageAndExit(fs, "max-key or max-line out of bound")
+		}
+		if *sample > 0 {
+			for name, unsupported := range map[string]bool{
+				"max-memory": *maxMemory != "0",
+				"spill":      *spill != "0",
+				"table":      *table == string(brc.BrcTableShared),
+			} {
+				if unsupported {
+					usageAndExit(fs, fmt.Sprintf("-sample can't be used with -%s %s", name, fs.Lookup(name).Value))
+				}
+			}
+		}
+		if *follow {
+			// the reader default may come from brc tune, only an explicit mmap is an error
+			explicit := make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+			for name, unsupported := range map[string]bool{
+				"trace":  len(*traceFile) > 0,
+				"table":  *table == string(brc.BrcTableShared),
+				"spill":  *spill != "0",
+				"sample": *sample > 0,
+				"reader": explicit["reader"] && *readerMode == string(brc.BrcReaderMmap),
+			} {
+				if unsupported {
+					usageAndExit(fs, fmt.Sprintf("-follow can't be used with -%s %s", name, fs.Lookup(name).Value))
+				}
+			}
+		}
+		outputPrecision := *precision
+		if outputPrecision == 0 {
+			outputPrecision = brc.BrcPrecisionInteger
+		}
+		maxMemoryBytes, err := brc.ParseByteSize(*maxMemory)
+		if err != nil {
+			usageAndExit(fs, err.Error())
+		}
+		spillBytes, err := brc.ParseByteSize(*spill)
+		if err != nil {
+			usageAndExit(fs, err.Error())
+		}
+		return solveCommand{
+			opts: brc.BrcOptions{
+				NThreads:        *nThreads,
+				ReadChunkFactor: *chunkSize,
+				Strategy:        brc.BrcStrategyType(*strategy),
+				ReaderType:      brc.BrcReaderType(*readerMode),
+				Verbose:         *verbose,
+				MaxMemory:       maxMemoryBytes,
+				TraceFile:       *traceFile,
+				Order:           brc.BrcOrderType(*order),
+				Number:          brc.BrcNumberType(*number),
+				Precision:       outputPrecision,
+				MaxKeySize:      *maxKey,
+				MaxLineSize:     *maxLine,
+				Table:           brc.BrcTableType(*table),
+				SpillMemory:     spillBytes,
+				SpillDir:        *spillDir,
+				Sample:          *sample,
+				SampleSeed:      *sampleSeed,
+			},
+			input:           *inputPath,
+			output:          *outputPath,
+			metricsFile:     *metricsFile,
+			metricsAddr:     *metricsAddr,
+			metricsStations: *metricsStations,
+			following:       *follow,
+			follow:          brc.FollowOptions{Interval: *followInterval, Lines: *followLines},
+			profiling:       *profiling,
+		}
+	}
+}
+
+// parseConfigured parses args, then sets the flags not given from the BRC_* variables and the config file,
+// only the shared ones for the other commands than solve. Returns where the value of each flag comes from
+func parseConfigured(fs *flag.FlagSet, args []string, shared ...string) map[string]string {
+	fs.Parse(args)
+	configPath := fs.Lookup("config").Value.String()
+	if len(configPath) == 0 {
+		configPath = os.Getenv("BRC_CONFIG")
+	}
+	sources, err := applySharedConfig(fs, configPath, shared)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	return sources
+}
+
+// configMain is `brc config show [solve options]`
+func configMain(args []string) {
+	fs, _ := newSolveFlags("config show")
+	if len(args) > 0 && args[0] == "show" {
+		showConfig(os.Stdout, fs, parseConfigured(fs, args[1:]))
+		return
+	}
+	fs.Parse(args)
+	usageAndExit(fs, "expected brc config show")
+}
+
+func solveMain(args []string) {
+	fs, parse := newSolveFlags("solve")
+	parseConfigured(fs, args)
+	cmd := parse()
+	opts := cmd.opts
+	input_file := cmd.input
+	if _, err := os.Stat(input_file); errors.Is(err, os.ErrNotExist) {
+		stderrAndExit(fmt.Sprintf("Input file does not exists or is not accessible: %s", err.Error()))
+	}
+	output_file := cmd.output
+	if len(output_file) == 0 {
+		err := os.Mkdir("output", 0o764)
+		if err != nil && !os.IsExist(err) {
+			stderrAndExit(fmt.Sprintf("Cannot create output folder: %s", err.Error()))
+		}
+		output_file = path.Join("./output", path.Base(input_file)) + ".out"
+	}
+	if len(cmd.metricsFile) > 0 || len(cmd.metricsAddr) > 0 {
+		opts.Metrics = brc.NewRunMetrics(cmd.metricsStations)
+	}
+	if len(cmd.metricsAddr) > 0 {
+		if err := serveMetrics(cmd.metricsAddr, opts.Metrics); err != nil {
+			stderrAndExit(fmt.Sprintf("Cannot serve metrics: %s", err.Error()))
+		}
+	}
+	if cmd.profiling {
+		f, err := os.Create("cpu.pprof")
+		if err != nil {
+			stderrAndExit(err.Error())
+		}
+		defer f.Close()
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+	if cmd.following {
+		followMain(input_file, output_file, cmd)
+		return
+	}
+	fileReader, err := brc.NewFileReader(opts.ReaderType)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if err = fileReader.Open(input_file); err != nil {
+		stderrAndExit(err.Error())
+	}
+	defer fileReader.Close()
+	timeBefore := time.Now()
+	err = brc.Solve(fileReader, output_file, opts)
+	timeAfter := time.Since(timeBefore)
+	if len(cmd.metricsFile) > 0 {
+		// also written on error, for brc_errors_total and brc_last_run_success
+		if err := writeMetricsFile(cmd.metricsFile, opts.Metrics); err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot write metrics: %s\n", err.Error())
+		}
+	}
+	if opts.Verbose {
+		fmt.Printf("Time taken total: %s\n", timeAfter.String())
+	}
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if opts.Verbose {
+		fmt.Fprintf(os.Stdout, "Output file: %s\n", output_file)
+	}
+}
+
+// followMain runs brc.Follow until SIGINT or SIGTERM, the metrics file is rewritten with the output
+func followMain(input_file, output_file string, cmd solveCommand) {
+	opts, follow := cmd.opts, cmd.follow
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	follow.Stop = stop
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	writeMetrics := func() {
+		if len(cmd.metricsFile) > 0 {
+			if err := writeMetricsFile(cmd.metricsFile, opts.Metrics); err != nil {
+				fmt.Fprintf(os.Stderr, "error: cannot write metrics: %s\n", err.Error())
+			}
+		}
+	}
+	follow.Refreshed = writeMetrics
+	if opts.Verbose {
+		fmt.Fprintf(os.Stdout, "Following %s in %s\n", input_file, output_file)
+	}
+	err := brc.Follow(input_file, output_file, opts, follow)
+	writeMetrics()
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	brc "brc/core"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tuneConfig is the winner of `brc tune`, used as default values by main
+type tuneConfig struct {
+	Threads int    `json:"threads"`
+	Chunk   int    `json:"chunk"`
+	Reader  string `json:"reader"`
+	Mode    string `json:"mode"`
+}
+
+func defaultTuneConfig() tuneConfig {
+	return tuneConfig{
+		Threads: runtime.NumCPU(),
+		Chunk:   (1024 * 1024) / os.Getpagesize(),
+		Reader:  string(brc.BrcReaderDisk),
+		Mode:    string(brc.BrcStrategyLazyRead),
+	}
+}
+
+// defaultTuneConfigPath is $XDG_CONFIG_HOME/brc/tune.json (or OS equivalent)
+func defaultTuneConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "brc", "tune.json")
+}
+
+// loadTuneConfig returns the default config overridden by the saved one, if any
+func loadTuneConfig(filename string) (tuneConfig, error) {
+	config := defaultTuneConfig()
+	if len(filename) == 0 {
+		return config, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("Invalid tune config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+func saveTuneConfig(filename string, config tuneConfig) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0o644)
+}
+
+func parseIntList(s string) ([]int, error) {
+	var lst []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid value in list: %q", v)
+		}
+		lst = append(lst, n)
+	}
+	return lst, nil
+}
+
+func parseEnumList[T ~string](s string, valid []T) ([]T, error) {
+	var lst []T
+	for _, v := range strings.Split(s, ",") {
+		e := T(strings.TrimSpace(v))
+		if !slices.Contains(valid, e) {
+			return nil, fmt.Errorf("invalid value in list: %q", v)
+		}
+		lst = append(lst, e)
+	}
+	return lst, nil
+}
+
+// copyPrefix copies the first size bytes of input, up to the last \n, in a new file of tmpDir
+func copyPrefix(input, tmpDir string, size int64) (string, error) {
+	in, err := os.Open(input)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	data, err := io.ReadAll(io.LimitReader(in, size))
+	if err != nil {
+		return "", err
+	}
+	if lastNl := bytes.LastIndexByte(data, '\n'); lastNl >= 0 {
+		data = data[:lastNl+1]
+	}
+	prefixFile := filepath.Join(tmpDir, "prefix-"+filepath.Base(input))
+	return prefixFile, os.WriteFile(prefixFile, data, 0o644)
+}
+
+func tuneMain(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	nCpu := runtime.NumCPU()
+	inputPath := fs.String("input", "", "Input file path")
+	threadsLst := fs.String("threads", fmt.Sprintf("%d,%d,%d", max(nCpu/2, 1), nCpu, nCpu*2), "Comma separated thread counts to try")
+	chunkLst := fs.String("chunk", "16,64,256,1024", "Comma separated chunk sizes to try (factors of pagesize)")
+	readerLst := fs.String("reader", "disk,mmap", "Comma separated readers to try")
+	modeLst := fs.String("mode", "lazy,preload", "Comma separated strategies to try")
+	repeat := fs.Int("repeat", 3, "Runs per configuration, the best one is kept")
+	prefix := fs.Int64("prefix", 0, "Only use the first N MB of the input (0=all)")
+	configPath := fs.String("save", defaultTuneConfigPath(), "Where to save the best configuration")
+	fs.Parse(args)
+	if len(*inputPath) == 0 {
+		usageAndExit(fs, "input is empty")
+	}
+	threads, err := parseIntList(*threadsLst)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	chunks, err := parseIntList(*chunkLst)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	readers, err := parseEnumList(*readerLst, brc.BrcReaderList)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	strategies, err := parseEnumList(*modeLst, brc.BrcStrategyList)
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	tmpDir, err := os.MkdirTemp("", "brc-tune")
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	input := *inputPath
+	if *prefix > 0 {
+		if input, err = copyPrefix(input, tmpDir, *prefix*1024*1024); err != nil {
+			stderrAndExit(err.Error())
+		}
+	}
+	candidates := brc.TuneGrid(threads, chunks, readers, strategies)
+	fmt.Printf("%-8s %-8s %-8s %-8s %12s %10s\n", "reader", "mode", "threads", "chunk", "time", "MB/s")
+	best, err := brc.Tune(input, tmpDir, candidates, *repeat, func(r brc.TuneResult) {
+		fmt.Printf("%-8s %-8s %-8d %-8d %12s %10.1f\n", r.Opts.ReaderType, r.Opts.Strategy,
+			r.Opts.NThreads, r.Opts.ReadChunkFactor, r.Duration, r.Throughput/1024/1024)
+	})
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	config := tuneConfig{
+		Threads: best.Opts.NThreads,
+		Chunk:   best.Opts.ReadChunkFactor,
+		Reader:  string(best.Opts.ReaderType),
+		Mode:    string(best.Opts.Strategy),
+	}
+	fmt.Printf("Best: -threads %d -chunk %d -reader %s -mode %s (%.1f MB/s)\n",
+		config.Threads, config.Chunk, config.Reader, config.Mode, best.Throughput/1024/1024)
+	if len(*configPath) > 0 {
+		if err := saveTuneConfig(*configPath, config); err != nil {
+			stderrAndExit(err.Error())
+		}
+		fmt.Printf("Saved to %s\n", *configPath)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	brc "brc/core"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// verifyMain checks all lines of the input with the solve threads, prints the report and exits with
+// exitFailed if solve can't parse some lines, exitWarning if it accepts them all but some are suspicious
+func verifyMain(args []string) {
+	tuned, err := loadTuneConfig(defaultTuneConfigPath())
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: brc verify [options] INPUT\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Exit codes: %d valid, %d invalid lines, %d error, %d warnings only\n", exitOK, exitFailed, exitError, exitWarning)
+	}
+	nThreads := fs.Int("threads", tuned.Threads, "Max number of threads to use (default=number of cores or tuned)")
+	chunkSize := fs.Int("chunk", tuned.Chunk, fmt.Sprintf("Chunk size per read (a factor of pagesize=%db, default=1Mb or tuned)", os.Getpagesize()))
+	readerMode := fs.String("reader", tuned.Reader, "Read from disk or mmap the file first [disk,mmap]")
+	number := fs.String("number", string(brc.BrcNumberFast), "Values format [fast,general]")
+	maxKey := fs.Int("max-key", brc.MAX_KEY_SIZE, "Longest station name in bytes")
+	maxLine := fs.Int("max-line", 0, "Longest line in bytes, \\n included (default=max-key+28)")
+	minValue := fs.Float64("min-value", -99.9, "Values under are out of range (a warning)")
+	maxValue := fs.Float64("max-value", 99.9, "Values over are out of range (a warning)")
+	jsonOutput := fs.Bool("json", false, "Print the report in JSON")
+	fs.String("config", "", "Config file of solve, for -threads, -chunk, -reader, -number, -max-key, -max-line, overridden by BRC_* env variables and flags (default=$BRC_CONFIG)")
+	parseConfigured(fs, args, "threads", "chunk", "reader", "number", "max-key", "max-line")
+	if fs.NArg() != 1 {
+		usageAndExit(fs, "expected an input file")
+	}
+	if *nThreads < 1 || *chunkSize < 1 {
+		usageAndExit(fs, "threads or chunk out of bound")
+	}
+	if !slices.Contains(brc.BrcReaderList, brc.BrcReaderType(*readerMode)) {
+		usageAndExit(fs, "mode unknown")
+	}
+	if !slices.Contains(brc.BrcNumberList, brc.BrcNumberType(*number)) {
+		usageAndExit(fs, "number format unknown")
+	}
+	if *maxKey < 1 || *maxLine < 0 {
+		usageAndExit(fs, "max-key or max-line out of bound")
+	}
+	fileReader, err := brc.NewFileReader(brc.BrcReaderType(*readerMode))
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if err := fileReader.Open(fs.Arg(0)); err != nil {
+		stderrAndExit(err.Error())
+	}
+	opts := brc.BrcOptions{
+		NThreads:        *nThreads,
+		ReadChunkFactor: *chunkSize,
+		ReaderType:      brc.BrcReaderType(*readerMode),
+		Number:          brc.BrcNumberType(*number),
+		MaxKeySize:      *maxKey,
+		MaxLineSize:     *maxLine,
+	}
+	report, err := brc.Verify(fileReader, opts, brc.VerifyOptions{MinValue: *minValue, MaxValue: *maxValue})
+	fileReader.Close()
+	if err != nil {
+		stderrAndExit(err.Error())
+	}
+	if *jsonOutput {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			stderrAndExit(err.Error())
+		}
+		os.Stdout.Write(append(data, '\n'))
+	} else {
+		printVerifyReport(os.Stdout, fs.Arg(0), report)
+	}
+	switch {
+	case report.Errors() > 0:
+		os.Exit(exitFailed)
+	case report.Warnings() > 0:
+		os.Exit(exitWarning)
+	}
+}
+
+func printVerifyReport(w io.Writer, input string, report *brc.VerifyReport) {
+	status := "valid"
+	if report.Errors() > 0 {
+		status = "invalid"
+	} else if report.Warnings() > 0 {
+		status = "valid with warnings"
+	}
+	fmt.Fprintf(w, "%s: %s, %d lines, %d bytes, %s numbers\n", input, status, report.Lines, report.Bytes, report.Number)
+	fmt.Fprintf(w, "Errors: %d\n", report.Errors())
+	printVerifyIssues(w, "malformed lines", report.Malformed)
+	printVerifyIssues(w, "names over the max key size", report.LongNames)
+	fmt.Fprintf(w, "Warnings: %d\n", report.Warnings())
+	printVerifyIssues(w, "names not valid UTF-8", report.InvalidUTF8)
+	printVerifyIssues(w, "values out of range", report.OutOfRange)
+	printHistogram(w, "Name length", report.NameLengths)
+	printHistogram(w, "Value", report.Values)
+}
+
+func printVerifyIssues(w io.Writer, name string, issues brc.VerifyIssues) {
+	fmt.Fprintf(w, "  %s: %d\n", name, issues.Count)
+	for _, issue := range issues.Examples {
+		fmt.Fprintf(w, "    byte %d: %s: %q\n", issue.Offset, issue.Reason, issue.Line)
+	}
+	if more := issues.Count - int64(len(issues.Examples)); more > 0 {
+		fmt.Fprintf(w, "    ... %d more\n", more)
+	}
+}
+
+func printHistogram(w io.Writer, name string, h brc.Histogram) {
+	if h.Count == 0 {
+		fmt.Fprintf(w, "%s: no values\n", name)
+		return
+	}
+	fmt.Fprintf(w, "%s: min %g, mean %.2f, max %g\n", name, h.Min, h.Mean(), h.Max)
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		var bucket string
+		switch {
+		case i == 0:
+			bucket = fmt.Sprintf("< %g", h.Bounds[0])
+		case i == len(h.Bounds):
+			bucket = fmt.Sprintf(">= %g", h.Bounds[i-1])
+		default:
+			bucket = fmt.Sprintf("[%g, %g)", h.Bounds[i-1], h.Bounds[i])
+		}
+		fmt.Fprintf(w, "  %-12s %12d %5.1f%%\n", bucket, count, float64(count)*100/float64(h.Count))
+	}
+}